@@ -1,12 +1,71 @@
 package events
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+
 	"github.com/ethereum/go-ethereum/common"
 )
 
-type OPExpire common.Hash
+type OPExpire struct {
+	Key   common.Hash    `json:"key"`
+	Owner common.Address `json:"owner"`
+}
+
+// UnmarshalJSON also accepts the bare entity key of archives written before
+// owners were recorded, either as a hex string or as an array of 32 bytes.
+func (o *OPExpire) UnmarshalJSON(data []byte) error {
+	return unmarshalEntity(data, &o.Key, &o.Owner)
+}
+
+type OPDelete struct {
+	Key   common.Hash    `json:"key"`
+	Owner common.Address `json:"owner"`
+}
+
+// UnmarshalJSON also accepts the bare entity key of archives written before
+// owners were recorded, either as a hex string or as an array of 32 bytes.
+func (o *OPDelete) UnmarshalJSON(data []byte) error {
+	return unmarshalEntity(data, &o.Key, &o.Owner)
+}
+
+// unmarshalEntity decodes an entity key and owner from a {"key", "owner"} object,
+// or just the key from a hex string or an array of 32 bytes.
+func unmarshalEntity(data []byte, key *common.Hash, owner *common.Address) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return errors.New("empty entity")
+	}
+
+	switch data[0] {
+	case '"':
+		return json.Unmarshal(data, key)
+	case '[':
+		var legacy [common.HashLength]byte
+		err := json.Unmarshal(data, &legacy)
+		if err != nil {
+			return err
+		}
+		*key = legacy
+		return nil
+	}
 
-type OPDelete common.Hash
+	entity := struct {
+		Key   common.Hash    `json:"key"`
+		Owner common.Address `json:"owner"`
+	}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&entity)
+	if err != nil {
+		return err
+	}
+	*key = entity.Key
+	*owner = entity.Owner
+	return nil
+}
 
 type OPCreate struct {
 	Key               common.Hash       `json:"key"`
@@ -16,6 +75,9 @@ type OPCreate struct {
 	Content           []byte            `json:"content"`
 	StringAttributes  map[string]string `json:"string_attributes"`
 	NumericAttributes map[string]uint64 `json:"numeric_attributes"`
+	ExpirationBlock   uint64            `json:"expiration_block,omitzero"`
+	// Cost is the fee paid for the operation in wei.
+	Cost *big.Int `json:"cost,omitempty"`
 }
 
 type OPContext struct {
@@ -25,18 +87,26 @@ type OPContext struct {
 }
 
 type OPUpdate struct {
-	Key               common.Hash       `json:"key"`
-	ContentType       string            `json:"content_type"`
-	BTL               uint64            `json:"btl"`
-	Owner             common.Address    `json:"owner"`
-	Content           []byte            `json:"content"`
-	StringAttributes  map[string]string `json:"string_attributes"`
-	NumericAttributes map[string]uint64 `json:"numeric_attributes"`
+	Key                common.Hash       `json:"key"`
+	ContentType        string            `json:"content_type"`
+	BTL                uint64            `json:"btl"`
+	Owner              common.Address    `json:"owner"`
+	Content            []byte            `json:"content"`
+	StringAttributes   map[string]string `json:"string_attributes"`
+	NumericAttributes  map[string]uint64 `json:"numeric_attributes"`
+	OldExpirationBlock uint64            `json:"old_expiration_block,omitzero"`
+	ExpirationBlock    uint64            `json:"expiration_block,omitzero"`
+	// Cost is the fee paid for the operation in wei.
+	Cost *big.Int `json:"cost,omitempty"`
 }
 
 type OPExtendBTL struct {
-	Key common.Hash `json:"key"`
-	BTL uint64      `json:"btl"`
+	Key                common.Hash `json:"key"`
+	BTL                uint64      `json:"btl"`
+	OldExpirationBlock uint64      `json:"old_expiration_block,omitzero"`
+	ExpirationBlock    uint64      `json:"expiration_block,omitzero"`
+	// Cost is the fee paid for the operation in wei.
+	Cost *big.Int `json:"cost,omitempty"`
 }
 
 type OPChangeOwner struct {
@@ -44,9 +114,23 @@ type OPChangeOwner struct {
 	Owner common.Address `json:"owner"`
 }
 
+// Operation is a change to an entity. Operations are ordered by (TxIndex, OpIndex),
+// which is unique within a block: TxIndex is the index of the transaction in the
+// block and OpIndex the position of the operation in the transaction. Arkiv
+// transactions apply creates, updates, deletes, BTL extensions and owner changes
+// in that order. Expirations emitted in a transaction's receipt are numbered
+// first, in the order their logs were emitted, followed by the transaction's
+// operations.
+// Archives written before operation positions were unique restart OpIndex for
+// every kind of operation. Sequence is the position of the operation in its
+// block, which is unique and ordered for all sources. It is derived by the
+// iterators rather than encoded, as it follows from the order of operations.
 type Operation struct {
 	TxIndex     uint64         `json:"tx_index"`
 	OpIndex     uint64         `json:"op_index"`
+	Sequence    uint64         `json:"-"`
+	TxHash      common.Hash    `json:"tx_hash,omitzero"`
+	From        common.Address `json:"from,omitzero"`
 	Delete      *OPDelete      `json:"delete,omitempty"`
 	Expire      *OPExpire      `json:"expire,omitempty"`
 	Create      *OPCreate      `json:"create,omitempty"`
@@ -57,6 +141,10 @@ type Operation struct {
 
 type Block struct {
 	Number     uint64      `json:"number"`
+	Hash       common.Hash `json:"hash,omitzero"`
+	ParentHash common.Hash `json:"parent_hash,omitzero"`
+	// Timestamp is the block time in seconds since the Unix epoch.
+	Timestamp  uint64      `json:"timestamp,omitzero"`
 	Operations []Operation `json:"operations"`
 }
 
@@ -6,9 +6,17 @@ import (
 	"github.com/Arkiv-Network/arkiv-events/events"
 )
 
+// Rollback signals that the blocks starting at FirstInvalidBlock are no longer
+// part of the canonical chain. Consumers must discard everything they derived
+// from those blocks; the canonical replacements follow in subsequent batches.
+type Rollback struct {
+	FirstInvalidBlock uint64
+}
+
 type BatchOrError struct {
-	Batch events.BlockBatch
-	Error error
+	Batch    events.BlockBatch
+	Rollback *Rollback
+	Error    error
 }
 
 type BatchIterator iter.Seq[BatchOrError]
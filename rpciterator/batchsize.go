@@ -0,0 +1,191 @@
+package rpciterator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// responseTooLargeErrorCode is the JSON-RPC error code geth uses for oversized batch responses.
+const responseTooLargeErrorCode = -32003
+
+// batchTooLargeErrorMessages are error messages of nodes and providers rejecting a batch because of its size.
+var batchTooLargeErrorMessages = []string{
+	"batch too large",
+	"batch size",
+	"batch limit",
+	"response too large",
+	"response size",
+	"request entity too large",
+}
+
+// batchSizer holds the number of blocks fetched per batch. With adaptive sizing
+// it halves the size on errors hinting at oversized batches and grows it while
+// batches are fetched faster than the target latency, but never back to a size
+// that failed.
+type batchSizer struct {
+	mu      sync.Mutex
+	current uint64
+	min     uint64
+	max     uint64
+	// limit is the largest size the batch size grows to: max, or less than the smallest failed size.
+	limit         uint64
+	adaptive      bool
+	targetLatency time.Duration
+	log           *slog.Logger
+}
+
+func newBatchSizer(o options) *batchSizer {
+	s := &batchSizer{
+		current: o.batchSize,
+		min:     o.batchSize,
+		max:     o.batchSize,
+		log:     o.log,
+	}
+	if o.adaptiveBatchSize != nil {
+		s.adaptive = true
+		s.min = o.adaptiveBatchSize.min
+		s.max = o.adaptiveBatchSize.max
+		s.targetLatency = o.adaptiveBatchSize.targetLatency
+		s.current = min(max(o.batchSize, s.min), s.max)
+	}
+	s.limit = s.max
+	return s
+}
+
+func (s *batchSizer) size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// canShrink reports whether err should make the batch size shrink instead of being retried.
+func (s *batchSizer) canShrink(err error) bool {
+	if !s.adaptive || !isBatchTooLarge(err) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current > s.min
+}
+
+// shrink halves the batch size if it is larger than size blocks, which were
+// requested by the failed batch. It reports whether a smaller batch is possible.
+func (s *batchSizer) shrink(size uint64, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size <= s.min {
+		return false
+	}
+	s.limit = min(s.limit, max(size-1, s.min))
+	if s.current >= size {
+		s.current = max(size/2, s.min)
+		s.log.Info("shrinking batch size", "batchSize", s.current, "error", err)
+	}
+	return true
+}
+
+// observe records that a batch of size blocks was fetched within latency.
+func (s *batchSizer) observe(size uint64, latency time.Duration) {
+	if !s.adaptive || latency >= s.targetLatency {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < s.current || s.current >= s.limit {
+		return
+	}
+	s.current = min(max(s.current+1, s.current*3/2), s.limit)
+	s.log.Debug("growing batch size", "batchSize", s.current, "latency", latency)
+}
+
+// isBatchTooLarge reports whether err hints at a batch that was too large to be
+// served: rejected batches or responses, HTTP 413 and timeouts.
+func isBatchTooLarge(err error) bool {
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusRequestEntityTooLarge
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, rpc.ErrMissingBatchResponse) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == responseTooLargeErrorCode {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, tooLarge := range batchTooLargeErrorMessages {
+		if strings.Contains(message, tooLarge) {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchSize returns the number of blocks currently fetched per batch.
+// It only changes over time if WithAdaptiveBatchSize is set.
+func (it *Iterator) BatchSize() uint64 {
+	return it.batchSize.size()
+}
+
+// fetchRetryPolicy is the retry policy for fetching windows of blocks. With adaptive
+// batch sizing, errors hinting at oversized batches are not retried as long as
+// the batch size can still shrink.
+func (it *Iterator) fetchRetryPolicy() RetryPolicy {
+	policy := it.opts.retryPolicy
+	if !it.batchSize.adaptive {
+		return policy
+	}
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	policy.Retryable = func(err error) bool {
+		return !it.batchSize.canShrink(err) && retryable(err)
+	}
+	return policy
+}
+
+// fetchWindow fetches the blocks in [startBlock, lastBlockNumber] and their receipts
+// in batches of the current batch size, adapting it as it goes.
+func (it *Iterator) fetchWindow(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, [][]RawReceipt, error) {
+	rawBlocks := []RawBlock{}
+	receipts := [][]RawReceipt{}
+
+	for start := startBlock; start <= lastBlockNumber; {
+		size := it.batchSize.size()
+		end := min(lastBlockNumber, start+size-1)
+
+		began := time.Now()
+		batchBlocks, batchReceipts, err := it.fetchRange(ctx, start, end)
+		if err != nil {
+			if it.batchSize.adaptive && isBatchTooLarge(err) && ctx.Err() == nil && it.batchSize.shrink(end-start+1, err) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("fetching blocks %d to %d: %w", start, end, err)
+		}
+		it.batchSize.observe(end-start+1, time.Since(began))
+
+		rawBlocks = append(rawBlocks, batchBlocks...)
+		receipts = append(receipts, batchReceipts...)
+		start = end + 1
+	}
+
+	return rawBlocks, receipts, nil
+}
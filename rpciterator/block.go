@@ -9,8 +9,9 @@ import (
 var ArkivProcessorAddress = common.HexToAddress("0x00000000000000000000000000000061726B6976")
 
 type RawReceipt struct {
-	Status hexutil.Uint64 `json:"status"`
-	Logs   []types.Log    `json:"logs"`
+	Status    hexutil.Uint64 `json:"status"`
+	BlockHash common.Hash    `json:"blockHash"`
+	Logs      []types.Log    `json:"logs"`
 }
 
 func (r RawReceipt) IsSuccessful() bool {
@@ -33,10 +34,21 @@ type RawTransaction struct {
 	// Cf. https://ethereum.org/developers/docs/apis/json-rpc/#eth_gettransactionbyhash
 	To   *common.Address `json:"to"`
 	From common.Address  `json:"from"`
+	Hash common.Hash     `json:"hash"`
 	Data hexutil.Bytes   `json:"input"`
 }
 
+// RawHeader holds the header fields of a block that are needed to follow the chain.
+// It can be decoded from eth_getBlockByNumber responses with or without full transactions.
+type RawHeader struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+	Timestamp  hexutil.Uint64 `json:"timestamp"`
+}
+
 type RawBlock struct {
-	Number       hexutil.Uint64   `json:"number"`
+	RawHeader
+	LogsBloom    types.Bloom      `json:"logsBloom"`
 	Transactions []RawTransaction `json:"transactions"`
 }
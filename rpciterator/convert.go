@@ -0,0 +1,266 @@
+package rpciterator
+
+import (
+	"fmt"
+
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/Arkiv-Network/arkiv-events/rpciterator/arkivtx"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// convertBlock translates a raw block and its receipts into Arkiv operations.
+func (it *Iterator) convertBlock(rawBlock RawBlock, rawReceipts []RawReceipt) (events.Block, error) {
+
+	block := events.Block{
+		Number:     uint64(rawBlock.Number),
+		Hash:       rawBlock.Hash,
+		ParentHash: rawBlock.ParentHash,
+		Timestamp:  uint64(rawBlock.Timestamp),
+		Operations: []events.Operation{},
+	}
+
+	// Blocks without receipts carry no transactions, or no Arkiv activity in logs-only mode.
+	if len(rawReceipts) == 0 {
+		return block, nil
+	}
+
+	for i, transaction := range rawBlock.Transactions {
+		expirations := []events.Operation{}
+		if i < len(rawReceipts) {
+			expirations = it.convertExpirations(rawBlock, i, rawReceipts[i])
+			block.Operations = append(block.Operations, expirations...)
+		}
+
+		if transaction.To == nil || *transaction.To != it.opts.processorAddress {
+			continue
+		}
+
+		if i >= len(rawReceipts) {
+			return events.Block{}, fmt.Errorf("block %d: no receipt for transaction %d", rawBlock.Number, i)
+		}
+		receipt := rawReceipts[i]
+
+		if !receipt.IsSuccessful() {
+			continue
+		}
+
+		atx, err := arkivtx.UnpackArkivTransaction(transaction.Data)
+		if err != nil {
+			return events.Block{}, fmt.Errorf("failed to unpack arkiv transaction: %w", err)
+		}
+
+		operations, err := it.convertTransaction(rawBlock, i, len(expirations), atx, receipt)
+		if err != nil {
+			return events.Block{}, err
+		}
+		block.Operations = append(block.Operations, operations...)
+	}
+
+	for i := range block.Operations {
+		block.Operations[i].Sequence = uint64(i)
+	}
+
+	return block, nil
+}
+
+// convertExpirations translates the expiration logs emitted by the processor
+// address in the receipt of the transaction at index i of rawBlock. Expirations
+// are emitted by housekeeping transactions, usually the first one of a block.
+func (it *Iterator) convertExpirations(rawBlock RawBlock, i int, receipt RawReceipt) []events.Operation {
+	operations := []events.Operation{}
+	for _, log := range receipt.Logs {
+		if log.Address != it.opts.processorAddress || len(log.Topics) < 2 || log.Topics[0] != ArkivEntityExpired {
+			continue
+		}
+		expire := events.OPExpire{Key: log.Topics[1]}
+		if len(log.Topics) > 2 {
+			expire.Owner = common.BytesToAddress(log.Topics[2].Bytes())
+		}
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(len(operations)),
+			TxHash:  rawBlock.Transactions[i].Hash,
+			From:    rawBlock.Transactions[i].From,
+			Expire:  &expire,
+		})
+	}
+	return operations
+}
+
+// convertTransaction translates the operations of the Arkiv transaction at index i
+// of rawBlock, matching every operation against the logs of its receipt. Their
+// OpIndex starts at firstOpIndex, after the expirations emitted by the transaction.
+func (it *Iterator) convertTransaction(rawBlock RawBlock, i int, firstOpIndex int, atx *arkivtx.ArkivTransaction, receipt RawReceipt) ([]events.Operation, error) {
+	transaction := rawBlock.Transactions[i]
+	logs := it.newReceiptLogs(receipt)
+	operations := []events.Operation{}
+
+	// OpIndex is the position of an operation in the transaction, which applies
+	// creates, updates, deletes, extensions and owner changes in that order.
+	updateOffset := firstOpIndex + len(atx.Create)
+	deleteOffset := updateOffset + len(atx.Update)
+	extendOffset := deleteOffset + len(atx.Delete)
+	changeOwnerOffset := extendOffset + len(atx.Extend)
+
+	mismatch := func(operation string, opIndex int, entityKey common.Hash, reason string) error {
+		return it.mismatch(&MismatchError{
+			BlockNumber: uint64(rawBlock.Number),
+			TxIndex:     uint64(i),
+			TxHash:      transaction.Hash,
+			Operation:   operation,
+			OpIndex:     opIndex,
+			EntityKey:   entityKey,
+			Reason:      reason,
+		})
+	}
+
+	for k, create := range atx.Create {
+		opIndex := firstOpIndex + k
+		createdLog, ok := logs.nextCreated()
+		if !ok {
+			err := mismatch("create", opIndex, common.Hash{}, "no ArkivEntityCreated log")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(opIndex),
+			TxHash:  transaction.Hash,
+			From:    transaction.From,
+			Create: &events.OPCreate{
+				Key:               createdLog.Topics[1],
+				ContentType:       create.ContentType,
+				BTL:               create.BTL,
+				Owner:             transaction.From,
+				Content:           create.Payload,
+				StringAttributes:  create.StringAttributes.ToMap(),
+				NumericAttributes: create.NumericAttributes.ToMap(),
+				ExpirationBlock:   logBlockNumber(createdLog, 0),
+				Cost:              logWord(createdLog, 1),
+			},
+		})
+	}
+
+	for k, update := range atx.Update {
+		opIndex := updateOffset + k
+		updatedLog, ok := logs.next(ArkivEntityUpdated, update.EntityKey)
+		if !ok {
+			err := mismatch("update", opIndex, update.EntityKey, "no ArkivEntityUpdated log")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(opIndex),
+			TxHash:  transaction.Hash,
+			From:    transaction.From,
+			Update: &events.OPUpdate{
+				Key:                update.EntityKey,
+				ContentType:        update.ContentType,
+				BTL:                update.BTL,
+				Owner:              transaction.From,
+				Content:            update.Payload,
+				StringAttributes:   update.StringAttributes.ToMap(),
+				NumericAttributes:  update.NumericAttributes.ToMap(),
+				OldExpirationBlock: logBlockNumber(updatedLog, 0),
+				ExpirationBlock:    logBlockNumber(updatedLog, 1),
+				Cost:               logWord(updatedLog, 2),
+			},
+		})
+	}
+
+	for k, deleteKey := range atx.Delete {
+		opIndex := deleteOffset + k
+		deletedLog, ok := logs.next(ArkivEntityDeleted, deleteKey)
+		if !ok {
+			err := mismatch("delete", opIndex, deleteKey, "no ArkivEntityDeleted log")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		deleted := events.OPDelete{Key: deleteKey}
+		if len(deletedLog.Topics) > 2 {
+			deleted.Owner = common.BytesToAddress(deletedLog.Topics[2].Bytes())
+		}
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(opIndex),
+			TxHash:  transaction.Hash,
+			From:    transaction.From,
+			Delete:  &deleted,
+		})
+	}
+
+	for k, extendBTL := range atx.Extend {
+		opIndex := extendOffset + k
+		extendedLog, ok := logs.next(ArkivEntityBTLExtended, extendBTL.EntityKey)
+		if !ok {
+			err := mismatch("extend_btl", opIndex, extendBTL.EntityKey, "no ArkivEntityBTLExtended log")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(opIndex),
+			TxHash:  transaction.Hash,
+			From:    transaction.From,
+			ExtendBTL: &events.OPExtendBTL{
+				Key:                extendBTL.EntityKey,
+				BTL:                extendBTL.NumberOfBlocks,
+				OldExpirationBlock: logBlockNumber(extendedLog, 0),
+				ExpirationBlock:    logBlockNumber(extendedLog, 1),
+				Cost:               logWord(extendedLog, 2),
+			},
+		})
+	}
+
+	for k, changeOwner := range atx.ChangeOwner {
+		opIndex := changeOwnerOffset + k
+		changedLog, ok := logs.next(ArkivEntityOwnerChanged, changeOwner.EntityKey)
+		if !ok {
+			err := mismatch("change_owner", opIndex, changeOwner.EntityKey, "no ArkivEntityOwnerChanged log")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(changedLog.Topics) > 3 && changedLog.Topics[3] != common.BytesToHash(changeOwner.NewOwner.Bytes()) {
+			err := mismatch("change_owner", opIndex, changeOwner.EntityKey, fmt.Sprintf("ArkivEntityOwnerChanged log names new owner %s", common.BytesToAddress(changedLog.Topics[3].Bytes())))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		operations = append(operations, events.Operation{
+			TxIndex: uint64(i),
+			OpIndex: uint64(opIndex),
+			TxHash:  transaction.Hash,
+			From:    transaction.From,
+			ChangeOwner: &events.OPChangeOwner{
+				Key:   changeOwner.EntityKey,
+				Owner: changeOwner.NewOwner,
+			},
+		})
+	}
+
+	for _, log := range logs.unmatched() {
+		err := mismatch(operationEvents[log.Topics[0]], -1, log.Topics[1], "no matching operation in transaction")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return operations, nil
+}
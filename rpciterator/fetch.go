@@ -0,0 +1,284 @@
+package rpciterator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/sync/errgroup"
+)
+
+// methodNotFoundErrorCode is the JSON-RPC error code for calls to unknown methods.
+const methodNotFoundErrorCode = -32601
+
+// errReceiptNotFound is returned if the node does not know the receipt of a
+// transaction it included in a block, which happens while it is still indexing.
+var errReceiptNotFound = errors.New("transaction receipt not found")
+
+// errBlockNotFound is returned if the node does not know a block yet. Nodes
+// behind load balancers may lag behind the head reported by another node.
+var errBlockNotFound = errors.New("block not found")
+
+// errChainChanged is returned if the node switched forks while a window was
+// being fetched, in a way the fetched blocks do not reveal themselves.
+var errChainChanged = errors.New("chain changed while fetching")
+
+// checkHeader returns errBlockNotFound unless header is the block with the given
+// number. Nodes answer null for blocks they do not know, which decodes to a zero header.
+func checkHeader(header RawHeader, number uint64) error {
+	if uint64(header.Number) != number || header.Hash == (common.Hash{}) {
+		return fmt.Errorf("fetching block %d: %w", number, errBlockNotFound)
+	}
+	return nil
+}
+
+// fetchHead returns the newest block the iterator is allowed to yield.
+func (it *Iterator) fetchHead(ctx context.Context) (uint64, error) {
+	if it.opts.headTag != nil {
+		var header *RawHeader
+		err := it.callContext(ctx, &header, "eth_getBlockByNumber", *it.opts.headTag, false)
+		if err != nil {
+			return 0, err
+		}
+		if header == nil {
+			// Chains that have not finalized a block yet answer null.
+			return 0, fmt.Errorf("node has no %s block: %w", it.opts.headTag, errBlockNotFound)
+		}
+		return uint64(header.Number), nil
+	}
+
+	var blockNumber hexutil.Uint64
+	err := it.callContext(ctx, &blockNumber, "eth_blockNumber")
+	if err != nil {
+		return 0, err
+	}
+	if uint64(blockNumber) < it.opts.confirmations {
+		return 0, nil
+	}
+	return uint64(blockNumber) - it.opts.confirmations, nil
+}
+
+// fetchRange fetches the blocks in [startBlock, lastBlockNumber] and their receipts.
+// In logs-only mode it delegates to fetchRangeFromLogs.
+// Receipts are fetched per block with eth_getBlockReceipts; if the node does not
+// implement it, the iterator switches to eth_getTransactionReceipt for good.
+func (it *Iterator) fetchRange(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, [][]RawReceipt, error) {
+	if it.opts.logsOnly {
+		return it.fetchRangeFromLogs(ctx, startBlock, lastBlockNumber)
+	}
+
+	if !it.blockReceiptsUnsupported.Load() {
+		rawBlocks, receipts, err := it.fetchBlocksAndBlockReceipts(ctx, startBlock, lastBlockNumber)
+		if err == nil || !isMethodNotFound(err) {
+			return rawBlocks, receipts, err
+		}
+		it.log.Warn("eth_getBlockReceipts is not available, falling back to eth_getTransactionReceipt", "error", err)
+		it.blockReceiptsUnsupported.Store(true)
+	}
+
+	rawBlocks, err := retry(ctx, it.fetchRetryPolicy(), it.log, "fetch blocks", func() ([]RawBlock, error) {
+		return it.fetchBlocks(ctx, startBlock, lastBlockNumber)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch blocks: %w", err)
+	}
+
+	receipts, err := retry(ctx, it.fetchRetryPolicy(), it.log, "fetch transaction receipts", func() ([][]RawReceipt, error) {
+		return it.fetchTransactionReceipts(ctx, rawBlocks)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch transaction receipts: %w", err)
+	}
+
+	return rawBlocks, receipts, nil
+}
+
+func (it *Iterator) fetchBlocksAndBlockReceipts(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, [][]RawReceipt, error) {
+
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	var rawBlocks []RawBlock
+
+	eg.Go(func() (err error) {
+		rawBlocks, err = retry(egCtx, it.fetchRetryPolicy(), it.log, "fetch blocks", func() ([]RawBlock, error) {
+			return it.fetchBlocks(egCtx, startBlock, lastBlockNumber)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch blocks: %w", err)
+		}
+		return nil
+	})
+
+	var receipts [][]RawReceipt
+
+	eg.Go(func() (err error) {
+		receipts, err = retry(egCtx, it.fetchRetryPolicy(), it.log, "fetch block receipts", func() ([][]RawReceipt, error) {
+			return it.fetchBlockReceipts(egCtx, startBlock, lastBlockNumber)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch block receipts: %w", err)
+		}
+		return nil
+	})
+
+	err := eg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawBlocks, receipts, nil
+}
+
+func (it *Iterator) fetchBlocks(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, error) {
+
+	batchSize := lastBlockNumber - startBlock + 1
+	batch := make([]rpc.BatchElem, batchSize)
+	blocks := make([]RawBlock, batchSize)
+	for i := range batchSize {
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []any{hexutil.Uint64(startBlock + i), true},
+			Result: &blocks[i],
+		}
+	}
+	err := it.batchCallContext(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to batch call: %w", err)
+	}
+	for i, b := range batch {
+		if b.Error != nil {
+			return nil, fmt.Errorf("fetching block %d: %w", startBlock+uint64(i), b.Error)
+		}
+		err = checkHeader(blocks[i].RawHeader, startBlock+uint64(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+func (it *Iterator) fetchBlockReceipts(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([][]RawReceipt, error) {
+
+	batchSize := lastBlockNumber - startBlock + 1
+
+	batch := make([]rpc.BatchElem, batchSize)
+	receipts := make([][]RawReceipt, batchSize)
+	for i := range batchSize {
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getBlockReceipts",
+			Args:   []any{hexutil.Uint64(startBlock + i)},
+			Result: &receipts[i],
+		}
+	}
+	err := it.batchCallContext(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to batch call: %w", err)
+	}
+	for i, b := range batch {
+		if b.Error != nil {
+			return nil, fmt.Errorf("fetching receipts for block %d: %w", startBlock+uint64(i), b.Error)
+		}
+		// Receipts of a block without transactions are an empty list, never null.
+		if receipts[i] == nil {
+			return nil, fmt.Errorf("fetching receipts for block %d: %w", startBlock+uint64(i), errBlockNotFound)
+		}
+	}
+	return receipts, nil
+}
+
+func (it *Iterator) fetchHeaders(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawHeader, error) {
+
+	batchSize := lastBlockNumber - startBlock + 1
+	batch := make([]rpc.BatchElem, batchSize)
+	headers := make([]RawHeader, batchSize)
+	for i := range batchSize {
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []any{hexutil.Uint64(startBlock + i), false},
+			Result: &headers[i],
+		}
+	}
+	err := it.batchCallContext(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to batch call: %w", err)
+	}
+	for i, b := range batch {
+		if b.Error != nil {
+			return nil, fmt.Errorf("fetching header %d: %w", startBlock+uint64(i), b.Error)
+		}
+		err = checkHeader(headers[i], startBlock+uint64(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+// fetchTransactionReceipts fetches the receipts of the housekeeping transaction
+// (the first one of every block, which emits expirations) and of all transactions
+// sent to the processor address. If a block's logs bloom hints at expirations
+// emitted by other transactions, the receipts of all its transactions are fetched.
+// The receipts of all other transactions are left empty.
+func (it *Iterator) fetchTransactionReceipts(ctx context.Context, rawBlocks []RawBlock) ([][]RawReceipt, error) {
+
+	receipts := make([][]RawReceipt, len(rawBlocks))
+	results := make([][]*RawReceipt, len(rawBlocks))
+	batch := []rpc.BatchElem{}
+	for i, rawBlock := range rawBlocks {
+		receipts[i] = make([]RawReceipt, len(rawBlock.Transactions))
+		results[i] = make([]*RawReceipt, len(rawBlock.Transactions))
+		mayExpire := rawBlock.LogsBloom.Test(it.opts.processorAddress.Bytes()) && rawBlock.LogsBloom.Test(ArkivEntityExpired.Bytes())
+		for j, transaction := range rawBlock.Transactions {
+			isArkivTransaction := transaction.To != nil && *transaction.To == it.opts.processorAddress
+			if j != 0 && !isArkivTransaction && !mayExpire {
+				continue
+			}
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []any{transaction.Hash},
+				Result: &results[i][j],
+			})
+		}
+	}
+
+	for chunk := range slices.Chunk(batch, int(it.batchSize.size())) {
+		err := it.batchCallContext(ctx, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to batch call: %w", err)
+		}
+		for _, b := range chunk {
+			if b.Error != nil {
+				return nil, fmt.Errorf("fetching receipt for transaction %s: %w", b.Args[0], b.Error)
+			}
+			if *b.Result.(**RawReceipt) == nil {
+				return nil, fmt.Errorf("fetching receipt for transaction %s: %w", b.Args[0], errReceiptNotFound)
+			}
+		}
+	}
+
+	for i := range results {
+		for j, result := range results[i] {
+			if result != nil {
+				receipts[i][j] = *result
+			}
+		}
+	}
+
+	return receipts, nil
+}
+
+// isMethodNotFound reports whether err means the node does not implement the called method.
+func isMethodNotFound(err error) bool {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == methodNotFoundErrorCode {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "method not found") ||
+		strings.Contains(message, "does not exist/is not available") ||
+		strings.Contains(message, "method not supported")
+}
@@ -0,0 +1,88 @@
+package rpciterator
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// headWatcher blocks the iterator until a new head is likely to be available.
+// When the RPC client supports subscriptions it wakes up on eth_subscribe("newHeads")
+// notifications; otherwise, or after the subscription dropped, it waits for the poll interval.
+type headWatcher struct {
+	it    *Iterator
+	heads chan RawHeader
+	sub   *rpc.ClientSubscription
+}
+
+func newHeadWatcher(it *Iterator) *headWatcher {
+	return &headWatcher{
+		it:    it,
+		heads: make(chan RawHeader, 16),
+	}
+}
+
+// subscriber is implemented by clients that can deliver eth_subscribe notifications, such as *rpc.Client.
+type subscriber interface {
+	SupportsSubscriptions() bool
+	EthSubscribe(ctx context.Context, channel any, args ...any) (*rpc.ClientSubscription, error)
+}
+
+// subscribe tries to establish the newHeads subscription if it is not active.
+func (w *headWatcher) subscribe(ctx context.Context) {
+	if w.sub != nil || !w.it.opts.subscribeHeads {
+		return
+	}
+	client, ok := w.it.rpcClient.(subscriber)
+	if !ok || !client.SupportsSubscriptions() {
+		return
+	}
+	sub, err := client.EthSubscribe(ctx, w.heads, "newHeads")
+	if err != nil {
+		w.it.log.Debug("newHeads subscription unavailable, polling for new blocks", "error", err)
+		return
+	}
+	w.sub = sub
+}
+
+// drain discards head notifications that arrived while the iterator was busy,
+// so that wait only returns early for heads announced after the drain.
+func (w *headWatcher) drain() {
+	for {
+		select {
+		case <-w.heads:
+		default:
+			return
+		}
+	}
+}
+
+// wait returns once a new head was announced, the poll interval elapsed or ctx is done.
+func (w *headWatcher) wait(ctx context.Context) {
+	w.subscribe(ctx)
+
+	var subErr <-chan error
+	if w.sub != nil {
+		subErr = w.sub.Err()
+	}
+
+	timer := time.NewTimer(w.it.opts.pollInterval)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-w.heads:
+	case err := <-subErr:
+		w.it.log.Warn("newHeads subscription dropped, falling back to polling", "error", err)
+		w.sub = nil
+	case <-timer.C:
+	}
+}
+
+func (w *headWatcher) close() {
+	if w.sub != nil {
+		w.sub.Unsubscribe()
+		w.sub = nil
+	}
+}
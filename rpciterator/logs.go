@@ -1,6 +1,12 @@
 package rpciterator
 
-import "github.com/ethereum/go-ethereum/crypto"
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
 
 // ArkivEntityCreated is the event signature for entity creation logs.
 // Parameters: entityKey (indexed), ownerAddress(indexed), expirationBlock, cost (wei)
@@ -25,3 +31,32 @@ var ArkivEntityBTLExtended = crypto.Keccak256Hash([]byte("ArkivEntityBTLExtended
 // ArkivEntityOwnerChanged is the event signature for changing the owner of an entity.
 // Parameters: entityKey (indexed), oldOwnerAddress(indexed), newOwnerAddress(indexed)
 var ArkivEntityOwnerChanged = crypto.Keccak256Hash([]byte("ArkivEntityOwnerChanged(uint256,address,address)"))
+
+// arkivEventTopics are the signatures of all events emitted by the Arkiv processor.
+var arkivEventTopics = []common.Hash{
+	ArkivEntityCreated,
+	ArkivEntityUpdated,
+	ArkivEntityExpired,
+	ArkivEntityDeleted,
+	ArkivEntityBTLExtended,
+	ArkivEntityOwnerChanged,
+}
+
+// logWord returns the i-th 32 byte word of the log's data as an integer,
+// or nil if the data is too short to hold it.
+func logWord(log types.Log, i int) *big.Int {
+	if len(log.Data) < (i+1)*32 {
+		return nil
+	}
+	return new(big.Int).SetBytes(log.Data[i*32 : (i+1)*32])
+}
+
+// logBlockNumber returns the i-th word of the log's data as a block number,
+// or zero if it is missing or does not fit a block number.
+func logBlockNumber(log types.Log, i int) uint64 {
+	word := logWord(log, i)
+	if word == nil || !word.IsUint64() {
+		return 0
+	}
+	return word.Uint64()
+}
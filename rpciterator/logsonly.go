@@ -0,0 +1,188 @@
+package rpciterator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// logFilter is the eth_getLogs filter object.
+type logFilter struct {
+	FromBlock hexutil.Uint64  `json:"fromBlock"`
+	ToBlock   hexutil.Uint64  `json:"toBlock"`
+	Address   common.Address  `json:"address"`
+	Topics    [][]common.Hash `json:"topics"`
+}
+
+// rawHeaderWithBloom is a block fetched without its transactions.
+type rawHeaderWithBloom struct {
+	RawHeader
+	LogsBloom types.Bloom `json:"logsBloom"`
+}
+
+// fetchRangeFromLogs fetches the blocks in [startBlock, lastBlockNumber] guided by
+// the Arkiv logs in that range. Blocks with Arkiv logs are fetched with their
+// transactions, and receipts holding those logs are reconstructed for them. All
+// other blocks are fetched as headers and have no transactions and receipts.
+// If a block without logs may have gained Arkiv logs in a reorg after the logs
+// were fetched, errChainChanged is returned.
+func (it *Iterator) fetchRangeFromLogs(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, [][]RawReceipt, error) {
+
+	logs, err := retry(ctx, it.fetchRetryPolicy(), it.log, "fetch logs", func() ([]types.Log, error) {
+		return it.fetchLogs(ctx, startBlock, lastBlockNumber)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch logs: %w", err)
+	}
+
+	logsByBlock := map[uint64][]types.Log{}
+	for _, log := range logs {
+		if log.Removed || log.BlockNumber < startBlock || log.BlockNumber > lastBlockNumber {
+			continue
+		}
+		logsByBlock[log.BlockNumber] = append(logsByBlock[log.BlockNumber], log)
+	}
+
+	rawBlocks, err := retry(ctx, it.fetchRetryPolicy(), it.log, "fetch blocks", func() ([]RawBlock, error) {
+		return it.fetchBlocksWithActivity(ctx, startBlock, lastBlockNumber, logsByBlock)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch blocks: %w", err)
+	}
+
+	err = it.checkLogsUnchanged(ctx, startBlock, lastBlockNumber, rawBlocks, logsByBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receipts := make([][]RawReceipt, len(rawBlocks))
+	for i, rawBlock := range rawBlocks {
+		blockLogs := logsByBlock[uint64(rawBlock.Number)]
+		if len(blockLogs) == 0 {
+			continue
+		}
+		receipts[i] = make([]RawReceipt, len(rawBlock.Transactions))
+		for _, log := range blockLogs {
+			if log.TxIndex >= uint(len(rawBlock.Transactions)) {
+				return nil, nil, fmt.Errorf("log of block %d refers to transaction %d, but the block has %d transactions", rawBlock.Number, log.TxIndex, len(rawBlock.Transactions))
+			}
+			// Only successful transactions emit logs.
+			receipt := &receipts[i][log.TxIndex]
+			receipt.Status = 1
+			receipt.BlockHash = log.BlockHash
+			receipt.Logs = append(receipt.Logs, log)
+		}
+	}
+
+	return rawBlocks, receipts, nil
+}
+
+func (it *Iterator) fetchLogs(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]types.Log, error) {
+	logs := []types.Log{}
+	err := it.callContext(ctx, &logs, "eth_getLogs", logFilter{
+		FromBlock: hexutil.Uint64(startBlock),
+		ToBlock:   hexutil.Uint64(lastBlockNumber),
+		Address:   it.opts.processorAddress,
+		Topics:    [][]common.Hash{arkivEventTopics},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// fetchBlocksWithActivity fetches the blocks present in logsByBlock with their
+// transactions and all other blocks in the range as headers only.
+func (it *Iterator) fetchBlocksWithActivity(ctx context.Context, startBlock uint64, lastBlockNumber uint64, logsByBlock map[uint64][]types.Log) ([]RawBlock, error) {
+
+	batchSize := lastBlockNumber - startBlock + 1
+	batch := make([]rpc.BatchElem, batchSize)
+	blocks := make([]RawBlock, batchSize)
+	headers := make([]rawHeaderWithBloom, batchSize)
+	for i := range batchSize {
+		number := startBlock + i
+		_, active := logsByBlock[number]
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []any{hexutil.Uint64(number), active},
+		}
+		if active {
+			batch[i].Result = &blocks[i]
+		} else {
+			batch[i].Result = &headers[i]
+		}
+	}
+	err := it.batchCallContext(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to batch call: %w", err)
+	}
+	for i, b := range batch {
+		if b.Error != nil {
+			return nil, fmt.Errorf("fetching block %d: %w", startBlock+uint64(i), b.Error)
+		}
+		if _, active := logsByBlock[startBlock+uint64(i)]; !active {
+			blocks[i] = RawBlock{RawHeader: headers[i].RawHeader, LogsBloom: headers[i].LogsBloom}
+		}
+		err = checkHeader(blocks[i].RawHeader, startBlock+uint64(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// checkLogsUnchanged returns errChainChanged if a reorg after the logs were fetched
+// replaced a block without Arkiv logs by one with them, which would otherwise be
+// yielded without its operations. Such blocks are spotted by their logs bloom; as
+// blooms have false positives, the logs are fetched again to confirm the change.
+func (it *Iterator) checkLogsUnchanged(ctx context.Context, startBlock uint64, lastBlockNumber uint64, rawBlocks []RawBlock, logsByBlock map[uint64][]types.Log) error {
+	suspicious := false
+	for _, rawBlock := range rawBlocks {
+		if _, active := logsByBlock[uint64(rawBlock.Number)]; !active && it.mayHaveArkivLogs(rawBlock.LogsBloom) {
+			suspicious = true
+			break
+		}
+	}
+	if !suspicious {
+		return nil
+	}
+
+	logs, err := retry(ctx, it.fetchRetryPolicy(), it.log, "fetch logs", func() ([]types.Log, error) {
+		return it.fetchLogs(ctx, startBlock, lastBlockNumber)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch logs: %w", err)
+	}
+
+	blockHashes := map[uint64]common.Hash{}
+	for _, log := range logs {
+		if log.Removed || log.BlockNumber < startBlock || log.BlockNumber > lastBlockNumber {
+			continue
+		}
+		if _, active := logsByBlock[log.BlockNumber]; !active || log.BlockHash != rawBlocks[log.BlockNumber-startBlock].Hash {
+			return fmt.Errorf("logs of block %d changed: %w", log.BlockNumber, errChainChanged)
+		}
+		blockHashes[log.BlockNumber] = log.BlockHash
+	}
+	if len(blockHashes) != len(logsByBlock) {
+		return fmt.Errorf("logs of blocks %d to %d changed: %w", startBlock, lastBlockNumber, errChainChanged)
+	}
+	return nil
+}
+
+// mayHaveArkivLogs reports whether bloom may hold Arkiv logs of the processor address.
+func (it *Iterator) mayHaveArkivLogs(bloom types.Bloom) bool {
+	if !bloom.Test(it.opts.processorAddress.Bytes()) {
+		return false
+	}
+	for _, topic := range arkivEventTopics {
+		if bloom.Test(topic.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
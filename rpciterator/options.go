@@ -0,0 +1,206 @@
+package rpciterator
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	defaultBatchSize    = 50
+	defaultPollInterval = 1 * time.Second
+)
+
+// Option configures an Iterator.
+type Option func(*options)
+
+type options struct {
+	log *slog.Logger
+	// batchSize is the maximum number of blocks fetched with a single batch call.
+	batchSize uint64
+	// pollInterval is the time waited before asking for a new head once the iterator caught up.
+	pollInterval time.Duration
+	// processorAddress is the address Arkiv transactions are sent to.
+	processorAddress common.Address
+	// confirmations is the number of blocks the iterator stays behind the latest block.
+	confirmations uint64
+	// headTag, if set, is the block tag (finalized or safe) that is followed instead of the latest block.
+	headTag *rpc.BlockNumber
+	// endBlock, if set, is the last block yielded before the iteration ends.
+	endBlock *uint64
+	// retryPolicy controls how failed RPC calls are retried.
+	retryPolicy RetryPolicy
+	// subscribeHeads enables waiting for new blocks through a newHeads subscription.
+	subscribeHeads bool
+	// logsOnly makes the iterator discover Arkiv activity through eth_getLogs.
+	logsOnly bool
+	// prefetchDepth is the number of batches fetched ahead of the batch being consumed.
+	prefetchDepth int
+	// adaptiveBatchSize, if set, bounds the batch size adapted at runtime.
+	adaptiveBatchSize *adaptiveBatchSize
+	// rateLimiter, if set, limits the RPC calls of the iterator.
+	rateLimiter *RateLimiter
+	// verification selects how operations not matching their receipt logs are handled.
+	verification VerificationMode
+}
+
+type adaptiveBatchSize struct {
+	min           uint64
+	max           uint64
+	targetLatency time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		log:              slog.Default(),
+		batchSize:        defaultBatchSize,
+		pollInterval:     defaultPollInterval,
+		processorAddress: ArkivProcessorAddress,
+		retryPolicy:      DefaultRetryPolicy,
+		subscribeHeads:   true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger used by the iterator. It defaults to slog.Default().
+func WithLogger(log *slog.Logger) Option {
+	return func(o *options) {
+		if log != nil {
+			o.log = log
+		}
+	}
+}
+
+// WithBatchSize sets the maximum number of blocks requested in a single JSON-RPC batch.
+// It defaults to 50.
+func WithBatchSize(n uint64) Option {
+	return func(o *options) {
+		o.batchSize = max(n, 1)
+	}
+}
+
+// WithAdaptiveBatchSize makes the iterator adapt the number of blocks per batch at
+// runtime, starting at the size given with WithBatchSize. The size is halved when
+// a batch fails because it or its response was too large or timed out, and grows
+// while batches are fetched faster than targetLatency. It always stays within
+// [minSize, maxSize]; the current size is reported by Iterator.BatchSize.
+func WithAdaptiveBatchSize(minSize uint64, maxSize uint64, targetLatency time.Duration) Option {
+	return func(o *options) {
+		minSize = max(minSize, 1)
+		o.adaptiveBatchSize = &adaptiveBatchSize{
+			min:           minSize,
+			max:           max(maxSize, minSize),
+			targetLatency: targetLatency,
+		}
+	}
+}
+
+// WithPollInterval sets how long the iterator waits before checking for new blocks
+// once it has caught up with the head. It defaults to one second. With an active
+// newHeads subscription it bounds the wait if a notification is missed.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// WithProcessorAddress sets the address Arkiv transactions are sent to.
+// It defaults to ArkivProcessorAddress.
+func WithProcessorAddress(address common.Address) Option {
+	return func(o *options) {
+		o.processorAddress = address
+	}
+}
+
+// WithHeadSubscription enables or disables waiting for new blocks through an
+// eth_subscribe("newHeads") subscription. It is enabled by default and only
+// takes effect for clients supporting subscriptions, such as websocket and IPC clients.
+func WithHeadSubscription(enabled bool) Option {
+	return func(o *options) {
+		o.subscribeHeads = enabled
+	}
+}
+
+// WithLogsOnly makes the iterator find Arkiv activity with eth_getLogs instead of
+// fetching the receipts of every block. Full blocks are only fetched for blocks
+// containing Arkiv logs; all other blocks are fetched as headers and yielded empty.
+// Receipts are reconstructed from the logs emitted by the processor address.
+func WithLogsOnly() Option {
+	return func(o *options) {
+		o.logsOnly = true
+	}
+}
+
+// WithPrefetch makes the iterator fetch up to depth upcoming batches in the
+// background while the current batch is being consumed. Batches are still yielded
+// in block order, and at most depth+1 batches are held in memory. It defaults to
+// zero, fetching the next batch only once the consumer asks for it.
+func WithPrefetch(depth int) Option {
+	return func(o *options) {
+		o.prefetchDepth = max(depth, 0)
+	}
+}
+
+// WithVerification sets how operations that do not match the logs of their
+// transaction's receipt are handled. It defaults to VerifyStrict, which yields a
+// *MismatchError ending the iteration; VerifyLenient logs a warning and skips the operation.
+func WithVerification(mode VerificationMode) Option {
+	return func(o *options) {
+		o.verification = mode
+	}
+}
+
+// WithRetryPolicy sets how failed RPC calls are retried before the iterator yields an error.
+// It defaults to DefaultRetryPolicy; use NoRetry to surface every error immediately.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithRateLimiter makes the iterator wait for limiter before every RPC call.
+// Passing the same RateLimiter to several iterators makes them share its budget.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(o *options) {
+		o.rateLimiter = limiter
+	}
+}
+
+// WithEndBlock makes the iteration end once the given block has been yielded,
+// instead of waiting for new blocks forever.
+func WithEndBlock(number uint64) Option {
+	return func(o *options) {
+		o.endBlock = &number
+	}
+}
+
+// WithConfirmations makes the iterator only yield blocks that are at least depth
+// blocks below the latest block. Reorgs shallower than depth are never observed.
+func WithConfirmations(depth uint64) Option {
+	return func(o *options) {
+		o.confirmations = depth
+		o.headTag = nil
+	}
+}
+
+// WithFinalizedHead makes the iterator follow the finalized block instead of the latest block.
+func WithFinalizedHead() Option {
+	return withHeadTag(rpc.FinalizedBlockNumber)
+}
+
+// WithSafeHead makes the iterator follow the safe block instead of the latest block.
+func WithSafeHead() Option {
+	return withHeadTag(rpc.SafeBlockNumber)
+}
+
+func withHeadTag(tag rpc.BlockNumber) Option {
+	return func(o *options) {
+		o.headTag = &tag
+		o.confirmations = 0
+	}
+}
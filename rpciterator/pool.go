@@ -0,0 +1,355 @@
+package rpciterator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// PoolStrategy selects the order in which a Pool tries its endpoints.
+type PoolStrategy int
+
+const (
+	// RoundRobin spreads calls evenly over all healthy endpoints.
+	RoundRobin PoolStrategy = iota
+	// Priority sends all calls to the first healthy endpoint, in the order they were given.
+	Priority
+)
+
+// PoolEndpoint is a named RPC endpoint of a Pool.
+type PoolEndpoint struct {
+	Name   string
+	Client Client
+}
+
+// PoolOption configures a Pool.
+type PoolOption func(*Pool)
+
+// WithPoolStrategy sets the endpoint selection strategy. It defaults to RoundRobin.
+func WithPoolStrategy(strategy PoolStrategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = strategy
+	}
+}
+
+// WithPoolLogger sets the logger used to report endpoint failures. It defaults to slog.Default().
+func WithPoolLogger(log *slog.Logger) PoolOption {
+	return func(p *Pool) {
+		if log != nil {
+			p.log = log
+		}
+	}
+}
+
+// WithHealthCheck makes the pool call eth_blockNumber on every endpoint at the given
+// interval, marking endpoints healthy or unhealthy depending on whether it succeeds
+// within timeout. Without health checks, failed endpoints are marked healthy again
+// as soon as a call to them succeeds.
+func WithHealthCheck(interval time.Duration, timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.healthCheckInterval = interval
+		p.healthCheckTimeout = timeout
+	}
+}
+
+// WithHedging makes the pool race a second endpoint for eth_getBlockByNumber calls
+// that did not complete within delay. The first successful response wins.
+func WithHedging(delay time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.hedgeDelay = delay
+	}
+}
+
+// Pool is a Client spreading calls over several RPC endpoints. Calls failing with
+// an error classified by IsRetryable are failed over to the next endpoint, and the
+// failing endpoint is considered unhealthy until it recovers. Unhealthy endpoints
+// are only used once all healthy endpoints failed.
+//
+// Pool does not support subscriptions, so iterators using it poll for new heads.
+type Pool struct {
+	endpoints []*poolEndpoint
+	strategy  PoolStrategy
+	log       *slog.Logger
+	next      atomic.Uint64
+
+	hedgeDelay          time.Duration
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+type poolEndpoint struct {
+	PoolEndpoint
+	unhealthy atomic.Bool
+}
+
+// NewPool creates a Pool over the given endpoints. Close must be called to stop
+// health checks once the pool is no longer used.
+func NewPool(endpoints []PoolEndpoint, opts ...PoolOption) (*Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("pool needs at least one endpoint")
+	}
+
+	p := &Pool{
+		log:                slog.Default(),
+		healthCheckTimeout: 5 * time.Second,
+		stop:               make(chan struct{}),
+	}
+	for _, endpoint := range endpoints {
+		p.endpoints = append(p.endpoints, &poolEndpoint{PoolEndpoint: endpoint})
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.healthCheckInterval > 0 {
+		p.done.Add(1)
+		go p.runHealthChecks()
+	}
+
+	return p, nil
+}
+
+// Close stops the health checks. It does not close the endpoints' clients.
+func (p *Pool) Close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	p.done.Wait()
+}
+
+// Healthy returns the names of the endpoints currently considered healthy.
+func (p *Pool) Healthy() []string {
+	names := []string{}
+	for _, endpoint := range p.endpoints {
+		if !endpoint.unhealthy.Load() {
+			names = append(names, endpoint.Name)
+		}
+	}
+	return names
+}
+
+// CallContext performs the call on the first endpoint that does not fail with a retryable error.
+func (p *Pool) CallContext(ctx context.Context, result any, method string, args ...any) error {
+	if p.hedgeDelay > 0 && method == "eth_getBlockByNumber" {
+		return hedge(p, ctx, func(ctx context.Context, endpoint *poolEndpoint) (json.RawMessage, error) {
+			var raw json.RawMessage
+			err := endpoint.Client.CallContext(ctx, &raw, method, args...)
+			return raw, err
+		}, func(raw json.RawMessage) error {
+			return json.Unmarshal(raw, result)
+		})
+	}
+
+	return p.failover(ctx, method, func(endpoint *poolEndpoint) error {
+		return endpoint.Client.CallContext(ctx, result, method, args...)
+	})
+}
+
+// BatchCallContext sends the batch to the first endpoint that answers it without
+// transport errors and without retryable errors in any of its elements.
+func (p *Pool) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	if p.hedgeDelay > 0 && len(b) > 0 && !slices.ContainsFunc(b, func(elem rpc.BatchElem) bool {
+		return elem.Method != "eth_getBlockByNumber"
+	}) {
+		return hedge(p, ctx, func(ctx context.Context, endpoint *poolEndpoint) ([]rpc.BatchElem, error) {
+			batch := make([]rpc.BatchElem, len(b))
+			for i, elem := range b {
+				batch[i] = rpc.BatchElem{Method: elem.Method, Args: elem.Args, Result: new(json.RawMessage)}
+			}
+			err := endpoint.Client.BatchCallContext(ctx, batch)
+			if err == nil {
+				err = batchError(batch)
+			}
+			return batch, err
+		}, func(batch []rpc.BatchElem) error {
+			for i, elem := range batch {
+				b[i].Error = elem.Error
+				if elem.Error == nil {
+					b[i].Error = json.Unmarshal(*elem.Result.(*json.RawMessage), b[i].Result)
+				}
+			}
+			return nil
+		})
+	}
+
+	return p.failover(ctx, "batch", func(endpoint *poolEndpoint) error {
+		for i := range b {
+			b[i].Error = nil
+		}
+		err := endpoint.Client.BatchCallContext(ctx, b)
+		if err != nil {
+			return err
+		}
+		return batchError(b)
+	})
+}
+
+// batchError returns the first retryable element error of a batch, so that the
+// batch is failed over to another endpoint. Other element errors are left to the caller.
+func batchError(b []rpc.BatchElem) error {
+	for _, elem := range b {
+		if elem.Error != nil && IsRetryable(elem.Error) {
+			return elem.Error
+		}
+	}
+	return nil
+}
+
+// order returns the endpoints in the order they should be tried: healthy
+// endpoints according to the strategy, followed by the unhealthy ones.
+func (p *Pool) order() []*poolEndpoint {
+	endpoints := p.endpoints
+	if p.strategy == RoundRobin {
+		offset := int((p.next.Add(1) - 1) % uint64(len(endpoints)))
+		endpoints = slices.Concat(endpoints[offset:], endpoints[:offset])
+	}
+	healthy := make([]*poolEndpoint, 0, len(endpoints))
+	unhealthy := []*poolEndpoint{}
+	for _, endpoint := range endpoints {
+		if endpoint.unhealthy.Load() {
+			unhealthy = append(unhealthy, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// report records the outcome of a call to endpoint.
+func (p *Pool) report(endpoint *poolEndpoint, operation string, err error) {
+	if err == nil {
+		if endpoint.unhealthy.Swap(false) {
+			p.log.Info("rpc endpoint recovered", "endpoint", endpoint.Name)
+		}
+		return
+	}
+	if IsRetryable(err) && !endpoint.unhealthy.Swap(true) {
+		p.log.Warn("rpc endpoint failed, failing over", "endpoint", endpoint.Name, "operation", operation, "error", err)
+	}
+}
+
+func (p *Pool) failover(ctx context.Context, operation string, call func(endpoint *poolEndpoint) error) error {
+	var err error
+	for _, endpoint := range p.order() {
+		err = call(endpoint)
+		p.report(endpoint, operation, err)
+		if err == nil || !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// hedge starts call on the first endpoint and, if it has not succeeded within the
+// hedge delay or failed, on the next one. The result of the first successful call
+// is passed to accept; the other call is cancelled.
+func hedge[T any](p *Pool, ctx context.Context, call func(ctx context.Context, endpoint *poolEndpoint) (T, error), accept func(T) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		result T
+		err    error
+	}
+
+	endpoints := p.order()
+	outcomes := make(chan outcome, len(endpoints))
+	start := func(endpoint *poolEndpoint) {
+		go func() {
+			result, err := call(ctx, endpoint)
+			if ctx.Err() == nil {
+				p.report(endpoint, "hedged call", err)
+			}
+			outcomes <- outcome{result: result, err: err}
+		}()
+	}
+
+	started, pending := 0, 0
+	launch := func() bool {
+		if started == len(endpoints) {
+			return false
+		}
+		start(endpoints[started])
+		started++
+		pending++
+		return true
+	}
+	launch()
+
+	timer := time.NewTimer(p.hedgeDelay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			launch()
+		case o := <-outcomes:
+			pending--
+			if o.err == nil {
+				return accept(o.result)
+			}
+			lastErr = o.err
+			if !IsRetryable(o.err) && ctx.Err() == nil {
+				return o.err
+			}
+			if pending == 0 {
+				launch()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return lastErr
+}
+
+func (p *Pool) runHealthChecks() {
+	defer p.done.Done()
+
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, endpoint := range p.endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), p.healthCheckTimeout)
+				defer cancel()
+
+				var blockNumber hexutil.Uint64
+				err := endpoint.Client.CallContext(ctx, &blockNumber, "eth_blockNumber")
+				if err != nil {
+					if !endpoint.unhealthy.Swap(true) {
+						p.log.Warn("rpc endpoint failed health check", "endpoint", endpoint.Name, "error", err)
+					}
+					return
+				}
+				if endpoint.unhealthy.Swap(false) {
+					p.log.Info("rpc endpoint recovered", "endpoint", endpoint.Name)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
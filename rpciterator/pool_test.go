@@ -0,0 +1,195 @@
+package rpciterator
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testEndpoint is an HTTP JSON-RPC endpoint serving a testChain that can be
+// taken down, slowed down and whose requests are counted.
+type testEndpoint struct {
+	down     atomic.Bool
+	delay    atomic.Int64
+	requests atomic.Int64
+	handler  http.Handler
+}
+
+func (e *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.requests.Add(1)
+	if e.down.Load() {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// Consume the body so the server notices cancelled requests while delaying.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	select {
+	case <-r.Context().Done():
+		return
+	case <-time.After(time.Duration(e.delay.Load())):
+	}
+	e.handler.ServeHTTP(w, r)
+}
+
+func newTestEndpoint(t *testing.T, chain *testChain, name string) (*testEndpoint, PoolEndpoint) {
+	t.Helper()
+
+	server := rpc.NewServer()
+	err := server.RegisterName("eth", &testEthService{chain: chain})
+	if err != nil {
+		t.Fatalf("failed to register eth service: %v", err)
+	}
+
+	endpoint := &testEndpoint{handler: server}
+	httpServer := httptest.NewServer(endpoint)
+
+	client, err := rpc.DialHTTP(httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", httpServer.URL, err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		httpServer.Close()
+		server.Stop()
+	})
+
+	return endpoint, PoolEndpoint{Name: name, Client: client}
+}
+
+func newTestPool(t *testing.T, endpoints []PoolEndpoint, opts ...PoolOption) *Pool {
+	t.Helper()
+	pool, err := NewPool(endpoints, append([]PoolOption{WithPoolLogger(testLogger())}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestPoolFailover(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(5)
+
+	primary, primaryEndpoint := newTestEndpoint(t, chain, "primary")
+	_, secondaryEndpoint := newTestEndpoint(t, chain, "secondary")
+	primary.down.Store(true)
+
+	pool := newTestPool(t, []PoolEndpoint{primaryEndpoint, secondaryEndpoint}, WithPoolStrategy(Priority))
+
+	iterator := New(pool, WithLogger(testLogger()), WithRetryPolicy(NoRetry), WithEndBlock(5))
+
+	blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 5)
+	if len(blocks) != 5 {
+		t.Fatalf("expected 5 blocks, got %d", len(blocks))
+	}
+
+	if diff := cmp.Diff([]string{"secondary"}, pool.Healthy()); diff != "" {
+		t.Fatalf("unexpected healthy endpoints (-want +got):\n%s", diff)
+	}
+	if requests := primary.requests.Load(); requests != 1 {
+		t.Fatalf("expected the unhealthy primary to be tried once, got %d requests", requests)
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	chain := newTestChain()
+
+	first, firstEndpoint := newTestEndpoint(t, chain, "first")
+	second, secondEndpoint := newTestEndpoint(t, chain, "second")
+
+	pool := newTestPool(t, []PoolEndpoint{firstEndpoint, secondEndpoint})
+
+	for range 4 {
+		var blockNumber hexutil.Uint64
+		err := pool.CallContext(context.Background(), &blockNumber, "eth_blockNumber")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if first.requests.Load() != 2 || second.requests.Load() != 2 {
+		t.Fatalf("expected requests to be spread evenly, got %d and %d", first.requests.Load(), second.requests.Load())
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	chain := newTestChain()
+
+	flaky, flakyEndpoint := newTestEndpoint(t, chain, "flaky")
+	_, stableEndpoint := newTestEndpoint(t, chain, "stable")
+
+	pool := newTestPool(t, []PoolEndpoint{flakyEndpoint, stableEndpoint}, WithHealthCheck(10*time.Millisecond, time.Second))
+
+	waitForHealthy := func(want []string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !slices.Equal(pool.Healthy(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected healthy endpoints %v, got %v", want, pool.Healthy())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	flaky.down.Store(true)
+	waitForHealthy([]string{"stable"})
+
+	flaky.down.Store(false)
+	waitForHealthy([]string{"flaky", "stable"})
+}
+
+func TestPoolHedging(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(2)
+
+	slow, slowEndpoint := newTestEndpoint(t, chain, "slow")
+	_, fastEndpoint := newTestEndpoint(t, chain, "fast")
+	slow.delay.Store(int64(10 * time.Second))
+
+	pool := newTestPool(t, []PoolEndpoint{slowEndpoint, fastEndpoint}, WithPoolStrategy(Priority), WithHedging(20*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var header RawHeader
+	err := pool.CallContext(ctx, &header, "eth_getBlockByNumber", hexutil.Uint64(1), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if header.Hash != chain.blocks[1].Hash {
+		t.Fatalf("expected header of block 1, got %v", header)
+	}
+
+	blocks := make([]RawBlock, 2)
+	batch := []rpc.BatchElem{
+		{Method: "eth_getBlockByNumber", Args: []any{hexutil.Uint64(1), true}, Result: &blocks[0]},
+		{Method: "eth_getBlockByNumber", Args: []any{hexutil.Uint64(2), true}, Result: &blocks[1]},
+	}
+	err = pool.BatchCallContext(ctx, batch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, elem := range batch {
+		if elem.Error != nil {
+			t.Fatalf("unexpected error in batch element %d: %v", i, elem.Error)
+		}
+		if blocks[i].Hash != chain.blocks[i+1].Hash {
+			t.Fatalf("expected block %d, got %v", i+1, blocks[i].RawHeader)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package rpciterator
+
+import "context"
+
+// fetchedWindow is a window of consecutive blocks fetched together with their receipts.
+type fetchedWindow struct {
+	startBlock uint64
+	endBlock   uint64
+	rawBlocks  []RawBlock
+	receipts   [][]RawReceipt
+	err        error
+}
+
+// prefetch fetches [startBlock, lastBlockNumber] in windows of the current batch
+// size. Windows are delivered in block order, each through its own channel that
+// receives the result once the window has been fetched. Up to prefetchDepth windows
+// are fetched ahead of the window being consumed; with a depth of zero a window is
+// only fetched once the consumer asks for it. Cancelling ctx stops the prefetching.
+func (it *Iterator) prefetch(ctx context.Context, startBlock uint64, lastBlockNumber uint64) <-chan chan fetchedWindow {
+	windows := make(chan chan fetchedWindow, it.opts.prefetchDepth)
+
+	go func() {
+		defer close(windows)
+
+		for start, end := startBlock, uint64(0); start <= lastBlockNumber; start = end + 1 {
+			end = min(lastBlockNumber, start+it.batchSize.size()-1)
+
+			result := make(chan fetchedWindow, 1)
+			select {
+			case windows <- result:
+			case <-ctx.Done():
+				return
+			}
+
+			go func() {
+				rawBlocks, receipts, err := it.fetchWindow(ctx, start, end)
+				result <- fetchedWindow{
+					startBlock: start,
+					endBlock:   end,
+					rawBlocks:  rawBlocks,
+					receipts:   receipts,
+					err:        err,
+				}
+			}()
+		}
+	}()
+
+	return windows
+}
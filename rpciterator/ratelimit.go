@@ -0,0 +1,116 @@
+package rpciterator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// RateLimiter limits the RPC requests and the batch elements sent per second
+// with token buckets. Every call counts as one request; a batch call counts as
+// one request and one element per batch entry, a single call as one of each.
+// Each bucket holds up to one second worth of tokens, so that bursts of that
+// size pass without waiting.
+//
+// A RateLimiter is safe for concurrent use and can be shared by several
+// iterators to enforce a process-wide budget, see WithRateLimiter.
+type RateLimiter struct {
+	mu       sync.Mutex
+	requests tokenBucket
+	elements tokenBucket
+}
+
+// NewRateLimiter creates a RateLimiter allowing requestsPerSecond requests and
+// elementsPerSecond batch elements per second. A rate of zero disables that limit.
+func NewRateLimiter(requestsPerSecond float64, elementsPerSecond float64) *RateLimiter {
+	now := time.Now()
+	return &RateLimiter{
+		requests: newTokenBucket(requestsPerSecond, now),
+		elements: newTokenBucket(elementsPerSecond, now),
+	}
+}
+
+// Wait blocks until a request with the given number of batch elements may be sent.
+// It returns ctx's error if ctx is done first, in which case no budget is consumed.
+func (l *RateLimiter) Wait(ctx context.Context, elements int) error {
+	l.mu.Lock()
+	now := time.Now()
+	delay := max(l.requests.reserve(1, now), l.elements.reserve(float64(elements), now))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.requests.cancel(1)
+		l.elements.cancel(float64(elements))
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second. Reservations
+// may overdraw it; the caller then waits until the debt has been refilled.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) tokenBucket {
+	return tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes n tokens and returns how long to wait before they are available.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns n reserved tokens.
+func (b *tokenBucket) cancel(n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens = min(b.rate, b.tokens+n)
+}
+
+// callContext performs a single RPC call, honoring the iterator's rate limiter.
+func (it *Iterator) callContext(ctx context.Context, result any, method string, args ...any) error {
+	if it.opts.rateLimiter != nil {
+		err := it.opts.rateLimiter.Wait(ctx, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return it.rpcClient.CallContext(ctx, result, method, args...)
+}
+
+// batchCallContext performs a batch RPC call, honoring the iterator's rate limiter.
+func (it *Iterator) batchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	if it.opts.rateLimiter != nil {
+		err := it.opts.rateLimiter.Wait(ctx, len(b))
+		if err != nil {
+			return err
+		}
+	}
+	return it.rpcClient.BatchCallContext(ctx, b)
+}
@@ -0,0 +1,68 @@
+package rpciterator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := NewRateLimiter(100, 0)
+	ctx := context.Background()
+
+	start := time.Now()
+	for range 100 {
+		err := limiter.Wait(ctx, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected the burst to pass without waiting, took %v", elapsed)
+	}
+
+	start = time.Now()
+	for range 20 {
+		err := limiter.Wait(ctx, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("expected 20 requests beyond the burst to take about 200ms, took %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := limiter.Wait(cancelled, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestIterateBlocksRateLimiter(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(50)
+
+	client := newTestClient(t, chain)
+
+	// The limiter is shared with another user that already spent its burst.
+	limiter := NewRateLimiter(0, 400)
+	err := limiter.Wait(context.Background(), 400)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	iterator := New(client, WithLogger(testLogger()), WithBatchSize(25), WithRateLimiter(limiter), WithEndBlock(50))
+
+	start := time.Now()
+	blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 50)
+	if len(blocks) != 50 {
+		t.Fatalf("expected 50 blocks, got %d", len(blocks))
+	}
+	// Blocks and receipts of 50 blocks are 100 batch elements, which take 250ms at 400 per second.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected the iteration to be rate limited, took %v", elapsed)
+	}
+}
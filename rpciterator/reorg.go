@@ -0,0 +1,87 @@
+package rpciterator
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// reorgWindowSize is the number of most recent block hashes kept to detect reorgs.
+// Reorgs deeper than this cannot be resolved and terminate the iterator.
+const reorgWindowSize = 128
+
+// blockHashWindow holds the hashes of the most recently yielded, consecutive blocks.
+type blockHashWindow struct {
+	headers []RawHeader
+}
+
+func (w *blockHashWindow) add(header RawHeader) {
+	if len(w.headers) > 0 && w.newest()+1 != uint64(header.Number) {
+		w.headers = w.headers[:0]
+	}
+	w.headers = append(w.headers, header)
+	if len(w.headers) > reorgWindowSize {
+		w.headers = w.headers[len(w.headers)-reorgWindowSize:]
+	}
+}
+
+func (w *blockHashWindow) empty() bool {
+	return len(w.headers) == 0
+}
+
+func (w *blockHashWindow) oldest() uint64 {
+	return uint64(w.headers[0].Number)
+}
+
+func (w *blockHashWindow) newest() uint64 {
+	return uint64(w.headers[len(w.headers)-1].Number)
+}
+
+// hash returns the hash recorded for the given block number, if it is still in the window.
+func (w *blockHashWindow) hash(number uint64) (common.Hash, bool) {
+	if w.empty() || number < w.oldest() || number > w.newest() {
+		return common.Hash{}, false
+	}
+	return w.headers[number-w.oldest()].Hash, true
+}
+
+// truncate drops all blocks after the given block number.
+func (w *blockHashWindow) truncate(number uint64) {
+	if w.empty() || number >= w.newest() {
+		return
+	}
+	if number < w.oldest() {
+		w.headers = w.headers[:0]
+		return
+	}
+	w.headers = w.headers[:number-w.oldest()+1]
+}
+
+// findCommonAncestor walks the hash window backwards and returns the newest
+// block whose recorded hash is still part of the canonical chain.
+func (it *Iterator) findCommonAncestor(ctx context.Context, window *blockHashWindow) (uint64, bool, error) {
+	end := window.newest()
+	for {
+		start := window.oldest()
+		if batchSize := it.batchSize.size(); end-start+1 > batchSize {
+			start = end - batchSize + 1
+		}
+		headers, err := retry(ctx, it.opts.retryPolicy, it.log, "fetch headers", func() ([]RawHeader, error) {
+			return it.fetchHeaders(ctx, start, end)
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		for i := len(headers) - 1; i >= 0; i-- {
+			number := uint64(headers[i].Number)
+			hash, _ := window.hash(number)
+			if headers[i].Hash == hash {
+				return number, true, nil
+			}
+		}
+		if start == window.oldest() {
+			return 0, false, nil
+		}
+		end = start - 1
+	}
+}
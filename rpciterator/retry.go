@@ -0,0 +1,145 @@
+package rpciterator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// RetryPolicy controls how failed RPC calls are retried before the iterator gives up.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts per call, including the first one.
+	// Values below 1 are treated as 1, i.e. no retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after every attempt.
+	Multiplier float64
+	// Jitter is the fraction of every delay that is randomized, between 0 and 1.
+	Jitter float64
+	// Retryable classifies errors as transient. It defaults to IsRetryable.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is the retry policy used unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// NoRetry is a retry policy that surfaces every error immediately.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// limitExceededErrorCode is the JSON-RPC error code (EIP-1474) nodes use for rate limiting.
+const limitExceededErrorCode = -32005
+
+// transientErrorMessages are error messages of nodes and load balancers that
+// are serving a block they have not caught up with yet.
+var transientErrorMessages = []string{
+	"header not found",
+	"block not found",
+	"unknown block",
+	"too many requests",
+	"rate limit",
+}
+
+// IsRetryable reports whether err is likely to be transient: HTTP 408, 429 and 5xx
+// responses, timeouts, dropped connections, rate limiting and nodes that do not
+// know a block or receipt yet. Cancellation of the caller's context is never retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusRequestTimeout ||
+			httpErr.StatusCode == http.StatusTooManyRequests ||
+			httpErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errReceiptNotFound) ||
+		errors.Is(err, errBlockNotFound) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == limitExceededErrorCode {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, transient := range transientErrorMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for range retry - 1 {
+		delay *= max(p.Multiplier, 1)
+		if p.MaxBackoff > 0 && delay >= float64(p.MaxBackoff) {
+			delay = float64(p.MaxBackoff)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		jitter := min(p.Jitter, 1)
+		delay = delay*(1-jitter) + delay*jitter*rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not retryable,
+// or the policy's attempts are exhausted. The last error is returned.
+func retry[T any](ctx context.Context, policy RetryPolicy, log *slog.Logger, operation string, fn func() (T, error)) (T, error) {
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			return result, err
+		}
+
+		delay := policy.backoff(attempt)
+		log.Warn("rpc call failed, retrying", "operation", operation, "attempt", attempt, "backoff", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(delay):
+		}
+	}
+}
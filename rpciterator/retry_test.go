@@ -0,0 +1,86 @@
+package rpciterator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "too many requests", err: rpc.HTTPError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "bad gateway", err: fmt.Errorf("failed to batch call: %w", rpc.HTTPError{StatusCode: http.StatusBadGateway}), want: true},
+		{name: "unauthorized", err: rpc.HTTPError{StatusCode: http.StatusUnauthorized}, want: false},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: true},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "header not found", err: errors.New("header not found"), want: true},
+		{name: "invalid argument", err: errors.New("invalid argument 0: hex string without 0x prefix"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Fatalf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, expected := range want {
+		if got := policy.backoff(i + 1); got != expected {
+			t.Fatalf("backoff(%d) = %v, want %v", i+1, got, expected)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for retry := 1; retry <= 5; retry++ {
+		got := policy.backoff(retry)
+		upper := min(policy.InitialBackoff<<(retry-1), policy.MaxBackoff)
+		if got < upper/2 || got > upper {
+			t.Fatalf("backoff(%d) = %v, want within [%v, %v]", retry, got, upper/2, upper)
+		}
+	}
+}
+
+func TestIterateBlocksRetriesTransientErrors(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(3)
+	chain.receiptFailures = 2
+
+	client := newTestClient(t, chain)
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0, WithRetryPolicy(policy)), 3)
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+
+	chain.addEmptyBlocks(1)
+	chain.receiptFailures = 3
+
+	for item := range IterateBlocks(context.Background(), testLogger(), client, 3, WithRetryPolicy(policy)) {
+		if item.Error == nil {
+			t.Fatalf("expected error once retries are exhausted, got batch %v", item.Batch)
+		}
+		break
+	}
+}
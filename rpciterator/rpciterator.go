@@ -2,248 +2,203 @@ package rpciterator
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	arkivevents "github.com/Arkiv-Network/arkiv-events"
 	"github.com/Arkiv-Network/arkiv-events/events"
-	"github.com/Arkiv-Network/arkiv-events/rpciterator/arkivtx"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
-	"golang.org/x/sync/errgroup"
 )
 
-const maxBlocksPerBatch = 50
-
+// IterateBlocks yields the Arkiv operations of all blocks after lastBlockNumber.
+// By default it follows the latest block; see WithConfirmations, WithFinalizedHead
+// and WithSafeHead for consumers that must not observe reorgs.
+//
+// IterateBlocks is a shorthand for New(rpcClient, WithLogger(log), opts...).Iterate(ctx, lastBlockNumber).
 func IterateBlocks(
 	ctx context.Context,
 	log *slog.Logger,
 	rpcClient *rpc.Client,
 	lastBlockNumber uint64,
+	opts ...Option,
 ) arkivevents.BatchIterator {
+	return New(rpcClient, append([]Option{WithLogger(log)}, opts...)...).Iterate(ctx, lastBlockNumber)
+}
 
-	fetchBlocksInBatch := func(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([]RawBlock, error) {
-
-		batchSize := min(maxBlocksPerBatch, lastBlockNumber-startBlock+1)
-		batch := make([]rpc.BatchElem, batchSize)
-		blocks := make([]RawBlock, batchSize)
-		for i := range uint64(batchSize) {
-			batch[i] = rpc.BatchElem{
-				Method: "eth_getBlockByNumber",
-				Args:   []any{hexutil.Uint64(startBlock + i), true},
-				Result: &blocks[i],
-			}
-		}
-		err := rpcClient.BatchCallContext(ctx, batch)
-		if err != nil {
-			return nil, fmt.Errorf("failed to batch call: %w", err)
-		}
-		for i, b := range batch {
-			if b.Error != nil {
-				return nil, fmt.Errorf("fetching block %d: %w", startBlock+uint64(i), b.Error)
-			}
-		}
-		return blocks, nil
-	}
+// Client is the part of *rpc.Client the iterator needs. Besides *rpc.Client it is
+// implemented by Pool, which spreads calls over several endpoints.
+type Client interface {
+	CallContext(ctx context.Context, result any, method string, args ...any) error
+	BatchCallContext(ctx context.Context, b []rpc.BatchElem) error
+}
 
-	fetchBlockReceiptsInBatch := func(ctx context.Context, startBlock uint64, lastBlockNumber uint64) ([][]RawReceipt, error) {
+// Iterator reads Arkiv operations from a node over JSON-RPC.
+type Iterator struct {
+	rpcClient Client
+	log       *slog.Logger
+	opts      options
+	batchSize *batchSizer
 
-		batchSize := min(maxBlocksPerBatch, lastBlockNumber-startBlock+1)
+	// blockReceiptsUnsupported is set once the node rejected eth_getBlockReceipts.
+	blockReceiptsUnsupported atomic.Bool
+}
 
-		batch := make([]rpc.BatchElem, batchSize)
-		receipts := make([][]RawReceipt, batchSize)
-		for i := range uint64(batchSize) {
-			batch[i] = rpc.BatchElem{
-				Method: "eth_getBlockReceipts",
-				Args:   []any{hexutil.Uint64(startBlock + i)},
-				Result: &receipts[i],
-			}
-		}
-		err := rpcClient.BatchCallContext(ctx, batch)
-		if err != nil {
-			return nil, fmt.Errorf("failed to batch call: %w", err)
-		}
-		for i, b := range batch {
-			if b.Error != nil {
-				return nil, fmt.Errorf("fetching receipts for block %d: %w", startBlock+uint64(i), b.Error)
-			}
-		}
-		return receipts, nil
+// New creates an Iterator reading from rpcClient, configured by opts.
+func New(rpcClient Client, opts ...Option) *Iterator {
+	o := newOptions(opts)
+	return &Iterator{
+		rpcClient: rpcClient,
+		log:       o.log,
+		opts:      o,
+		batchSize: newBatchSizer(o),
 	}
+}
 
-	ec := ethclient.NewClient(rpcClient)
+// Iterate yields the Arkiv operations of all blocks after lastBlockNumber.
+// Unless WithEndBlock is set, the iteration follows the head until ctx is cancelled.
+// If a reorg of already yielded blocks is detected, a Rollback naming the first
+// invalidated block is yielded before the canonical blocks are replayed.
+// Reorgs can only be detected for blocks yielded by this iteration.
+// Failed RPC calls are retried according to the iterator's RetryPolicy; an
+// error is only yielded, ending the iteration, once the retries are exhausted.
+// Blocks the node does not know yet are retried the same way, as are batches that
+// changed forks while being fetched; without a backoff in the policy, those are
+// refetched after the poll interval.
+// Once caught up, new blocks are awaited through a newHeads subscription if the
+// client supports it, and by polling every poll interval otherwise. While catching
+// up, WithPrefetch lets upcoming batches be fetched while the current one is consumed.
+func (it *Iterator) Iterate(ctx context.Context, lastBlockNumber uint64) arkivevents.BatchIterator {
 
 	return func(yield func(arkivevents.BatchOrError) bool) {
 
-		for {
+		window := &blockHashWindow{}
 
-			blockNumber, err := ec.BlockNumber(ctx)
-			if err != nil {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to get block number: %w", err)})
-				return
-			}
+		// inconsistentFetches counts the consecutive fetches that did not form a
+		// single chain; refetching is retried like a failed RPC call.
+		inconsistentFetches := 0
 
-			if lastBlockNumber >= blockNumber {
-				// log.Info("Last block number is greater than current block number", "lastBlockNumber", lastBlockNumber, "currentBlockNumber", blockNumber)
-				log.Info("waiting for new blocks", "lastBlockNumber", lastBlockNumber, "currentBlockNumber", blockNumber)
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(1 * time.Second):
-				}
-				continue
-			}
+		heads := newHeadWatcher(it)
+		defer heads.close()
 
-			eg, egCtx := errgroup.WithContext(ctx)
+		// iterateRound yields the blocks up to blockNumber. It returns false if the
+		// iteration must end, and true once the round is done or must be restarted
+		// from lastBlockNumber because the chain changed.
+		iterateRound := func(blockNumber uint64) bool {
+			roundCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
 
-			var rawBlocks []RawBlock
+			for pending := range it.prefetch(roundCtx, lastBlockNumber+1, blockNumber) {
 
-			eg.Go(func() (err error) {
-				rawBlocks, err = fetchBlocksInBatch(egCtx, lastBlockNumber+1, blockNumber)
-				if err != nil {
-					return fmt.Errorf("failed to fetch blocks: %w", err)
+				fetched := <-pending
+				chainChanged := errors.Is(fetched.err, errChainChanged)
+				if fetched.err != nil && !chainChanged {
+					yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to fetch blocks or block receipts: %w", fetched.err)})
+					return false
 				}
-				return nil
-			})
 
-			var receipts [][]RawReceipt
+				rawBlocks, receipts := fetched.rawBlocks, fetched.receipts
 
-			eg.Go(func() (err error) {
-				receipts, err = fetchBlockReceiptsInBatch(egCtx, lastBlockNumber+1, blockNumber)
-				if err != nil {
-					return fmt.Errorf("failed to fetch block receipts: %w", err)
+				if chainChanged || !chainIsConsistent(rawBlocks, receipts) {
+					inconsistentFetches++
+					if inconsistentFetches >= it.opts.retryPolicy.MaxAttempts {
+						yield(arkivevents.BatchOrError{Error: fmt.Errorf("blocks %d to %d did not form a single chain in %d attempts", fetched.startBlock, fetched.endBlock, inconsistentFetches)})
+						return false
+					}
+					delay := it.opts.retryPolicy.backoff(inconsistentFetches)
+					if delay == 0 {
+						delay = it.opts.pollInterval
+					}
+					it.log.Warn("chain changed while fetching blocks, refetching", "firstBlock", fetched.startBlock, "lastBlock", fetched.endBlock, "backoff", delay)
+					select {
+					case <-ctx.Done():
+						return false
+					case <-time.After(delay):
+					}
+					return true
 				}
-				return nil
-			})
+				inconsistentFetches = 0
 
-			err = eg.Wait()
-			if err != nil {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to fetch blocks or block receipts: %w", err)})
-				return
-			}
-
-			blocks := []events.Block{}
-
-			for i, rawBlock := range rawBlocks {
-				rawReceipts := receipts[i]
+				expectedParent, known := window.hash(lastBlockNumber)
+				if known && rawBlocks[0].ParentHash != expectedParent {
+					ancestor, found, err := it.findCommonAncestor(ctx, window)
+					if err != nil {
+						yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to find common ancestor after reorg: %w", err)})
+						return false
+					}
+					if !found {
+						yield(arkivevents.BatchOrError{Error: fmt.Errorf("reorg at block %d is deeper than %d blocks", rawBlocks[0].Number, reorgWindowSize)})
+						return false
+					}
 
-				block := events.Block{
-					Number:     uint64(rawBlock.Number),
-					Operations: []events.Operation{},
-				}
+					it.log.Warn("chain reorganization detected", "firstInvalidBlock", ancestor+1, "lastBlockNumber", lastBlockNumber)
 
-				lastBlockNumber = uint64(rawBlock.Number)
+					window.truncate(ancestor)
+					lastBlockNumber = ancestor
 
-				if len(rawReceipts) == 0 {
-					continue
+					return yield(arkivevents.BatchOrError{Rollback: &arkivevents.Rollback{FirstInvalidBlock: ancestor + 1}})
 				}
 
-				firstReceipt := rawReceipts[0]
+				blocks := []events.Block{}
 
-				opIndex := uint64(0)
+				for i, rawBlock := range rawBlocks {
+					rawReceipts := receipts[i]
 
-				for _, log := range firstReceipt.Logs {
-					if log.Topics[0] == ArkivEntityExpired && len(log.Data) >= 32 {
-						entityKey := common.BytesToHash(log.Data[:32])
-						expire := events.OPExpire(entityKey.Bytes())
-						block.Operations = append(block.Operations, events.Operation{
-							TxIndex: 0,
-							OpIndex: opIndex,
-							Expire:  &expire,
-						})
-					}
-				}
+					lastBlockNumber = uint64(rawBlock.Number)
+					window.add(rawBlock.RawHeader)
 
-				for i, transaction := range rawBlock.Transactions {
-					if transaction.To == nil || *transaction.To != ArkivProcessorAddress {
-						continue
+					block, err := it.convertBlock(rawBlock, rawReceipts)
+					if err != nil {
+						yield(arkivevents.BatchOrError{Error: err})
+						return false
 					}
 
-					receipt := rawReceipts[i]
+					blocks = append(blocks, block)
 
-					if !receipt.IsSuccessful() {
-						continue
-					}
+				}
 
-					atx, err := arkivtx.UnpackArkivTransaction(transaction.Data)
-					if err != nil {
-						yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to unpack arkiv transaction: %w", err)})
-						return
-					}
+				if !yield(arkivevents.BatchOrError{Batch: events.BlockBatch{Blocks: blocks}}) {
+					return false
+				}
 
-					createdEntities := receipt.CreatedEntities()
-
-					for opIndex, create := range atx.Create {
-						createdEntityKey := createdEntities[0]
-						createdEntities = createdEntities[1:]
-
-						block.Operations = append(block.Operations, events.Operation{
-							TxIndex: uint64(i),
-							OpIndex: uint64(opIndex),
-							Create: &events.OPCreate{
-								Key:               createdEntityKey,
-								ContentType:       create.ContentType,
-								BTL:               create.BTL,
-								Owner:             transaction.From,
-								Content:           create.Payload,
-								StringAttributes:  create.StringAttributes.ToMap(),
-								NumericAttributes: create.NumericAttributes.ToMap(),
-							},
-						})
-					}
+			}
 
-					for opIndex, update := range atx.Update {
-
-						block.Operations = append(block.Operations, events.Operation{
-							TxIndex: uint64(i),
-							OpIndex: uint64(opIndex),
-							Update: &events.OPUpdate{
-								Key:               update.EntityKey,
-								ContentType:       update.ContentType,
-								BTL:               update.BTL,
-								Owner:             transaction.From,
-								Content:           update.Payload,
-								StringAttributes:  update.StringAttributes.ToMap(),
-								NumericAttributes: update.NumericAttributes.ToMap(),
-							},
-						})
-					}
+			return true
+		}
 
-					for opIndex, extendBTL := range atx.Extend {
+		for {
 
-						block.Operations = append(block.Operations, events.Operation{
-							TxIndex: uint64(i),
-							OpIndex: uint64(opIndex),
-							ExtendBTL: &events.OPExtendBTL{
-								Key: extendBTL.EntityKey,
-								BTL: extendBTL.NumberOfBlocks,
-							},
-						})
+			if it.opts.endBlock != nil && lastBlockNumber >= *it.opts.endBlock {
+				return
+			}
 
-					}
-					for opIndex, changeOwner := range atx.ChangeOwner {
+			heads.drain()
 
-						block.Operations = append(block.Operations, events.Operation{
-							TxIndex: uint64(i),
-							OpIndex: uint64(opIndex),
-							ChangeOwner: &events.OPChangeOwner{
-								Key:   changeOwner.EntityKey,
-								Owner: changeOwner.NewOwner,
-							},
-						})
+			blockNumber, err := retry(ctx, it.opts.retryPolicy, it.log, "fetch head", func() (uint64, error) {
+				return it.fetchHead(ctx)
+			})
+			if err != nil {
+				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to get block number: %w", err)})
+				return
+			}
 
-					}
+			if it.opts.endBlock != nil {
+				blockNumber = min(blockNumber, *it.opts.endBlock)
+			}
 
+			if lastBlockNumber >= blockNumber {
+				it.log.Info("waiting for new blocks", "lastBlockNumber", lastBlockNumber, "currentBlockNumber", blockNumber)
+				heads.wait(ctx)
+				if ctx.Err() != nil {
+					return
 				}
-
-				blocks = append(blocks, block)
-
+				continue
 			}
 
-			if !yield(arkivevents.BatchOrError{Batch: events.BlockBatch{Blocks: blocks}}) {
+			if !iterateRound(blockNumber) {
 				return
 			}
 
@@ -252,3 +207,21 @@ func IterateBlocks(
 	}
 
 }
+
+// chainIsConsistent reports whether the fetched blocks form a single chain and
+// the receipts belong to those blocks. Both can be violated if the node switched
+// to a different fork while the batch calls were being served.
+// Receipts without a block hash were not fetched and are ignored.
+func chainIsConsistent(rawBlocks []RawBlock, receipts [][]RawReceipt) bool {
+	for i, rawBlock := range rawBlocks {
+		if i > 0 && rawBlock.ParentHash != rawBlocks[i-1].Hash {
+			return false
+		}
+		for _, receipt := range receipts[i] {
+			if receipt.BlockHash != (common.Hash{}) && receipt.BlockHash != rawBlock.Hash {
+				return false
+			}
+		}
+	}
+	return true
+}
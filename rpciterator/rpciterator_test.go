@@ -0,0 +1,1361 @@
+package rpciterator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/Arkiv-Network/arkiv-events/rpciterator/arkivtx"
+	"github.com/andybalholm/brotli"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/google/go-cmp/cmp"
+)
+
+var testOwner = common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+// testGenesisTime is the timestamp of the test chain's genesis block; blocks follow every two seconds.
+const testGenesisTime = 1_700_000_000
+
+// testChain is an in-memory chain served over JSON-RPC by testEthService.
+type testChain struct {
+	mu        sync.Mutex
+	fork      uint64
+	finalized uint64
+	safe      uint64
+	// receiptFailures is the number of upcoming eth_getBlockReceipts calls that fail.
+	receiptFailures int
+	// headSubscribers receive the header of every added block.
+	headSubscribers map[chan RawHeader]struct{}
+	// fullBlockRequests counts eth_getBlockByNumber calls asking for full transactions.
+	fullBlockRequests int
+	blocks            []RawBlock
+	receipts          [][]RawReceipt
+}
+
+func newTestChain() *testChain {
+	return &testChain{
+		blocks: []RawBlock{{
+			RawHeader:    RawHeader{Number: 0, Hash: crypto.Keccak256Hash([]byte("genesis")), Timestamp: testGenesisTime},
+			Transactions: []RawTransaction{},
+		}},
+		receipts: [][]RawReceipt{{}},
+	}
+}
+
+// addBlock appends a block containing the given transactions and receipts.
+func (c *testChain) addBlock(transactions []RawTransaction, receipts []RawReceipt) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	number := uint64(len(c.blocks))
+	parent := c.blocks[number-1].Hash
+	hash := crypto.Keccak256Hash(parent.Bytes(), binary.BigEndian.AppendUint64(nil, number), binary.BigEndian.AppendUint64(nil, c.fork))
+
+	for i := range transactions {
+		transactions[i].Hash = crypto.Keccak256Hash(hash.Bytes(), binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+	for i := range receipts {
+		receipts[i].BlockHash = hash
+		for j := range receipts[i].Logs {
+			receipts[i].Logs[j].TxHash = transactions[i].Hash
+		}
+	}
+
+	var bloom types.Bloom
+	for _, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			bloom.Add(log.Address.Bytes())
+			for _, topic := range log.Topics {
+				bloom.Add(topic.Bytes())
+			}
+		}
+	}
+
+	c.blocks = append(c.blocks, RawBlock{
+		RawHeader:    RawHeader{Number: hexutil.Uint64(number), Hash: hash, ParentHash: parent, Timestamp: hexutil.Uint64(testGenesisTime + 2*number)},
+		LogsBloom:    bloom,
+		Transactions: transactions,
+	})
+	c.receipts = append(c.receipts, receipts)
+
+	for subscriber := range c.headSubscribers {
+		select {
+		case subscriber <- c.blocks[number].RawHeader:
+		default:
+		}
+	}
+
+	return number
+}
+
+func (c *testChain) fetchedFullBlocks() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fullBlockRequests
+}
+
+// annotate sets the hash, parent hash and timestamp of the chain's blocks on the
+// given blocks, and the hash and sender of the transactions and the position in
+// the block on their operations.
+func (c *testChain) annotate(blocks []events.Block) []events.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, block := range blocks {
+		rawBlock := c.blocks[block.Number]
+		blocks[i].Hash = rawBlock.Hash
+		blocks[i].ParentHash = rawBlock.ParentHash
+		blocks[i].Timestamp = uint64(rawBlock.Timestamp)
+		for j, operation := range block.Operations {
+			transaction := rawBlock.Transactions[operation.TxIndex]
+			blocks[i].Operations[j].TxHash = transaction.Hash
+			blocks[i].Operations[j].From = transaction.From
+			blocks[i].Operations[j].Sequence = uint64(j)
+		}
+	}
+	return blocks
+}
+
+// reorg drops all blocks from firstInvalidBlock onwards; blocks added afterwards get new hashes.
+func (c *testChain) reorg(firstInvalidBlock uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fork++
+	c.blocks = c.blocks[:firstInvalidBlock]
+	c.receipts = c.receipts[:firstInvalidBlock]
+}
+
+// addEmptyBlocks appends n blocks that only contain a housekeeping transaction.
+func (c *testChain) addEmptyBlocks(n int) {
+	for range n {
+		c.addBlock([]RawTransaction{{}}, []RawReceipt{successfulReceipt()})
+	}
+}
+
+type testEthService struct {
+	chain *testChain
+}
+
+func (s *testEthService) BlockNumber() hexutil.Uint64 {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+	return hexutil.Uint64(len(s.chain.blocks) - 1)
+}
+
+func (s *testEthService) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (*RawBlock, error) {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+	switch number {
+	case rpc.LatestBlockNumber:
+		number = rpc.BlockNumber(len(s.chain.blocks) - 1)
+	case rpc.FinalizedBlockNumber:
+		number = rpc.BlockNumber(s.chain.finalized)
+	case rpc.SafeBlockNumber:
+		number = rpc.BlockNumber(s.chain.safe)
+	}
+	if number < 0 || int(number) >= len(s.chain.blocks) {
+		return nil, fmt.Errorf("header not found")
+	}
+	if !fullTx {
+		return &RawBlock{RawHeader: s.chain.blocks[number].RawHeader, LogsBloom: s.chain.blocks[number].LogsBloom}, nil
+	}
+	s.chain.fullBlockRequests++
+	return &s.chain.blocks[number], nil
+}
+
+func (s *testEthService) GetBlockReceipts(number rpc.BlockNumber) ([]RawReceipt, error) {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+	if s.chain.receiptFailures > 0 {
+		s.chain.receiptFailures--
+		return nil, fmt.Errorf("header not found")
+	}
+	if number < 0 || int(number) >= len(s.chain.receipts) {
+		return nil, fmt.Errorf("header not found")
+	}
+	return s.chain.receipts[number], nil
+}
+
+func (s *testEthService) GetTransactionReceipt(hash common.Hash) (*RawReceipt, error) {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+	for i, block := range s.chain.blocks {
+		for j, transaction := range block.Transactions {
+			if transaction.Hash == hash {
+				return &s.chain.receipts[i][j], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *testEthService) GetLogs(filter logFilter) ([]types.Log, error) {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+
+	topics := map[common.Hash]bool{}
+	for _, topic := range filter.Topics[0] {
+		topics[topic] = true
+	}
+
+	logs := []types.Log{}
+	for number := uint64(filter.FromBlock); number <= uint64(filter.ToBlock) && number < uint64(len(s.chain.blocks)); number++ {
+		block := s.chain.blocks[number]
+		for txIndex, receipt := range s.chain.receipts[number] {
+			for _, log := range receipt.Logs {
+				if log.Address != filter.Address || !topics[log.Topics[0]] {
+					continue
+				}
+				log.BlockNumber = number
+				log.BlockHash = block.Hash
+				log.TxIndex = uint(txIndex)
+				log.TxHash = block.Transactions[txIndex].Hash
+				logs = append(logs, log)
+			}
+		}
+	}
+	return logs, nil
+}
+
+func (s *testEthService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	heads := make(chan RawHeader, 16)
+	s.chain.mu.Lock()
+	if s.chain.headSubscribers == nil {
+		s.chain.headSubscribers = map[chan RawHeader]struct{}{}
+	}
+	s.chain.headSubscribers[heads] = struct{}{}
+	s.chain.mu.Unlock()
+
+	subscription := notifier.CreateSubscription()
+	go func() {
+		defer func() {
+			s.chain.mu.Lock()
+			delete(s.chain.headSubscribers, heads)
+			s.chain.mu.Unlock()
+		}()
+		for {
+			select {
+			case header := <-heads:
+				err := notifier.Notify(subscription.ID, header)
+				if err != nil {
+					return
+				}
+			case <-subscription.Err():
+				return
+			}
+		}
+	}()
+
+	return subscription, nil
+}
+
+// testEthServiceWithoutBlockReceipts mimics nodes that do not implement eth_getBlockReceipts.
+type testEthServiceWithoutBlockReceipts struct {
+	eth *testEthService
+}
+
+func (s *testEthServiceWithoutBlockReceipts) BlockNumber() hexutil.Uint64 {
+	return s.eth.BlockNumber()
+}
+
+func (s *testEthServiceWithoutBlockReceipts) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (*RawBlock, error) {
+	return s.eth.GetBlockByNumber(number, fullTx)
+}
+
+func (s *testEthServiceWithoutBlockReceipts) GetTransactionReceipt(hash common.Hash) (*RawReceipt, error) {
+	return s.eth.GetTransactionReceipt(hash)
+}
+
+// testEthServiceAhead mimics load-balanced nodes that report a head they cannot
+// serve yet: once ahead is set, the head is one block past the chain, and unknown
+// blocks are answered with null, like geth does.
+type testEthServiceAhead struct {
+	eth   *testEthService
+	ahead atomic.Bool
+}
+
+func (s *testEthServiceAhead) BlockNumber() hexutil.Uint64 {
+	if s.ahead.Load() {
+		return s.eth.BlockNumber() + 1
+	}
+	return s.eth.BlockNumber()
+}
+
+func (s *testEthServiceAhead) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (*RawBlock, error) {
+	if number >= 0 && hexutil.Uint64(number) > s.eth.BlockNumber() {
+		return nil, nil
+	}
+	return s.eth.GetBlockByNumber(number, fullTx)
+}
+
+func (s *testEthServiceAhead) GetBlockReceipts(number rpc.BlockNumber) ([]RawReceipt, error) {
+	if number >= 0 && hexutil.Uint64(number) > s.eth.BlockNumber() {
+		return nil, nil
+	}
+	return s.eth.GetBlockReceipts(number)
+}
+
+// testEthServiceForked mimics a node whose receipts always come from another fork
+// than its blocks.
+type testEthServiceForked struct {
+	*testEthService
+}
+
+func (s *testEthServiceForked) GetBlockReceipts(number rpc.BlockNumber) ([]RawReceipt, error) {
+	receipts, err := s.testEthService.GetBlockReceipts(number)
+	if err != nil {
+		return nil, err
+	}
+	forked := slices.Clone(receipts)
+	for i := range forked {
+		forked[i].BlockHash = crypto.Keccak256Hash(forked[i].BlockHash.Bytes())
+	}
+	return forked, nil
+}
+
+// testEthServiceUnfinalized mimics a chain that has not finalized a block yet:
+// until finalized is set, it answers null for the finalized tag.
+type testEthServiceUnfinalized struct {
+	*testEthService
+	finalized atomic.Bool
+}
+
+func (s *testEthServiceUnfinalized) GetBlockByNumber(number rpc.BlockNumber, fullTx bool) (*RawBlock, error) {
+	if number == rpc.FinalizedBlockNumber && !s.finalized.Load() {
+		return nil, nil
+	}
+	return s.testEthService.GetBlockByNumber(number, fullTx)
+}
+
+// testEthServiceReorgAfterLogs runs reorg once, right after answering the first eth_getLogs call.
+type testEthServiceReorgAfterLogs struct {
+	*testEthService
+	reorg func()
+	once  sync.Once
+}
+
+func (s *testEthServiceReorgAfterLogs) GetLogs(filter logFilter) ([]types.Log, error) {
+	logs, err := s.testEthService.GetLogs(filter)
+	s.once.Do(s.reorg)
+	return logs, err
+}
+
+func newTestClient(t *testing.T, chain *testChain) *rpc.Client {
+	t.Helper()
+	return newTestClientWithService(t, &testEthService{chain: chain})
+}
+
+func newTestClientWithService(t *testing.T, service any) *rpc.Client {
+	t.Helper()
+	server := rpc.NewServer()
+	err := server.RegisterName("eth", service)
+	if err != nil {
+		t.Fatalf("failed to register eth service: %v", err)
+	}
+	client := rpc.DialInProc(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Stop()
+	})
+	return client
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// packArkivTransaction encodes atx the same way the Arkiv processor expects it in transaction input.
+func packArkivTransaction(t *testing.T, atx *arkivtx.ArkivTransaction) []byte {
+	t.Helper()
+	encoded, err := rlp.EncodeToBytes(atx)
+	if err != nil {
+		t.Fatalf("failed to encode arkiv transaction: %v", err)
+	}
+	var compressed bytes.Buffer
+	writer := brotli.NewWriter(&compressed)
+	_, err = writer.Write(encoded)
+	if err != nil {
+		t.Fatalf("failed to compress arkiv transaction: %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("failed to close brotli writer: %v", err)
+	}
+	return compressed.Bytes()
+}
+
+func arkivTransaction(t *testing.T, from common.Address, atx *arkivtx.ArkivTransaction) RawTransaction {
+	t.Helper()
+	return RawTransaction{
+		To:   &ArkivProcessorAddress,
+		From: from,
+		Data: packArkivTransaction(t, atx),
+	}
+}
+
+func arkivLog(topics ...common.Hash) types.Log {
+	return types.Log{
+		Address: ArkivProcessorAddress,
+		Topics:  topics,
+		Data:    []byte{},
+	}
+}
+
+// withData sets the log's data to the given 32 byte words.
+func withData(log types.Log, words ...*big.Int) types.Log {
+	log.Data = []byte{}
+	for _, word := range words {
+		log.Data = append(log.Data, common.BigToHash(word).Bytes()...)
+	}
+	return log
+}
+
+func successfulReceipt(logs ...types.Log) RawReceipt {
+	if logs == nil {
+		logs = []types.Log{}
+	}
+	return RawReceipt{Status: 1, Logs: logs}
+}
+
+// collectBlocks iterates until the block with number lastBlock has been yielded.
+func collectBlocks(t *testing.T, iterator arkivevents.BatchIterator, lastBlock uint64) []events.Block {
+	t.Helper()
+	blocks := []events.Block{}
+	for item := range iterator {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		blocks = append(blocks, item.Batch.Blocks...)
+		if len(blocks) > 0 && blocks[len(blocks)-1].Number >= lastBlock {
+			break
+		}
+	}
+	return blocks
+}
+
+func TestIterateBlocksDelete(t *testing.T) {
+	chain := newTestChain()
+
+	createdKey := common.HexToHash("0x01")
+	deletedKey := common.HexToHash("0x02")
+
+	chain.addBlock(
+		[]RawTransaction{
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(arkivLog(ArkivEntityCreated, createdKey, common.BytesToHash(testOwner.Bytes()))),
+		},
+	)
+	chain.addBlock(
+		[]RawTransaction{
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Delete: []common.Hash{createdKey, deletedKey},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(
+				arkivLog(ArkivEntityDeleted, createdKey, common.BytesToHash(testOwner.Bytes())),
+				arkivLog(ArkivEntityDeleted, deletedKey, common.BytesToHash(testOwner.Bytes())),
+			),
+		},
+	)
+
+	client := newTestClient(t, chain)
+
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0), 2)
+
+	deletedCreated := events.OPDelete{Key: createdKey, Owner: testOwner}
+	deletedOther := events.OPDelete{Key: deletedKey, Owner: testOwner}
+
+	expected := []events.Block{
+		{
+			Number: 1,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+			},
+		},
+		{
+			Number: 2,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Delete: &deletedCreated},
+				{TxIndex: 0, OpIndex: 1, Delete: &deletedOther},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(chain.annotate(expected), blocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateBlocksLogData(t *testing.T) {
+	chain := newTestChain()
+
+	createdKey := common.HexToHash("0x01")
+	updatedKey := common.HexToHash("0x02")
+	extendedKey := common.HexToHash("0x03")
+	owner := common.BytesToHash(testOwner.Bytes())
+	cost := new(big.Int).Exp(big.NewInt(10), big.NewInt(20), nil)
+
+	chain.addBlock(
+		[]RawTransaction{
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+				Update: []arkivtx.ArkivUpdate{{EntityKey: updatedKey, BTL: 200, ContentType: "text/plain", Payload: []byte("world")}},
+				Extend: []arkivtx.ExtendBTL{{EntityKey: extendedKey, NumberOfBlocks: 300}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(
+				withData(arkivLog(ArkivEntityCreated, createdKey, owner), big.NewInt(101), cost),
+				withData(arkivLog(ArkivEntityUpdated, updatedKey, owner), big.NewInt(50), big.NewInt(201), big.NewInt(2)),
+				withData(arkivLog(ArkivEntityBTLExtended, extendedKey, owner), big.NewInt(60), big.NewInt(360), big.NewInt(3)),
+			),
+		},
+	)
+
+	client := newTestClient(t, chain)
+
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0), 1)
+
+	expected := []events.Block{
+		{
+			Number: 1,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+					ExpirationBlock:   101,
+					Cost:              cost,
+				}},
+				{TxIndex: 0, OpIndex: 1, Update: &events.OPUpdate{
+					Key:                updatedKey,
+					ContentType:        "text/plain",
+					BTL:                200,
+					Owner:              testOwner,
+					Content:            []byte("world"),
+					StringAttributes:   map[string]string{},
+					NumericAttributes:  map[string]uint64{},
+					OldExpirationBlock: 50,
+					ExpirationBlock:    201,
+					Cost:               big.NewInt(2),
+				}},
+				{TxIndex: 0, OpIndex: 2, ExtendBTL: &events.OPExtendBTL{
+					Key:                extendedKey,
+					BTL:                300,
+					OldExpirationBlock: 60,
+					ExpirationBlock:    360,
+					Cost:               big.NewInt(3),
+				}},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(chain.annotate(expected), blocks, cmp.Comparer(func(a, b *big.Int) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Cmp(b) == 0)
+	})); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateBlocksDeleteWithoutLog(t *testing.T) {
+	chain := newTestChain()
+
+	chain.addBlock(
+		[]RawTransaction{
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Delete: []common.Hash{common.HexToHash("0x01")},
+			}),
+		},
+		[]RawReceipt{successfulReceipt()},
+	)
+
+	client := newTestClient(t, chain)
+
+	for item := range IterateBlocks(context.Background(), testLogger(), client, 0) {
+		if item.Error == nil {
+			t.Fatalf("expected error for delete without deleted entity log, got batch %v", item.Batch)
+		}
+		break
+	}
+}
+
+func TestIterateBlocksVerification(t *testing.T) {
+	chain := newTestChain()
+
+	createdKey := common.HexToHash("0x01")
+	strayKey := common.HexToHash("0x02")
+	owner := common.BytesToHash(testOwner.Bytes())
+
+	// The second create has no created entity log, and an update log has no operation.
+	chain.addBlock(
+		[]RawTransaction{
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{
+					{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")},
+					{BTL: 200, ContentType: "text/plain", Payload: []byte("world")},
+				},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(
+				arkivLog(ArkivEntityCreated, createdKey, owner),
+				arkivLog(ArkivEntityUpdated, strayKey, owner),
+			),
+		},
+	)
+
+	client := newTestClient(t, chain)
+
+	var mismatch *MismatchError
+	for item := range IterateBlocks(context.Background(), testLogger(), client, 0) {
+		if !errors.As(item.Error, &mismatch) {
+			t.Fatalf("expected a mismatch error, got %v", item.Error)
+		}
+		break
+	}
+	expected := &MismatchError{
+		BlockNumber: 1,
+		TxIndex:     0,
+		TxHash:      chain.blocks[1].Transactions[0].Hash,
+		Operation:   "create",
+		OpIndex:     1,
+		Reason:      "no ArkivEntityCreated log",
+	}
+	if diff := cmp.Diff(expected, mismatch); diff != "" {
+		t.Fatalf("unexpected mismatch error (-want +got):\n%s", diff)
+	}
+
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0, WithVerification(VerifyLenient)), 1)
+	operations := blocks[0].Operations
+	if len(operations) != 1 || operations[0].Create == nil || operations[0].Create.Key != createdKey {
+		t.Fatalf("expected only the create with a matching log, got %v", operations)
+	}
+}
+
+func TestIterateBlocksReorg(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(3)
+
+	client := newTestClient(t, chain)
+
+	next, stop := iter.Pull(iter.Seq[arkivevents.BatchOrError](IterateBlocks(context.Background(), testLogger(), client, 0)))
+	defer stop()
+
+	item, _ := next()
+	if item.Error != nil {
+		t.Fatalf("unexpected error during iteration: %v", item.Error)
+	}
+	if len(item.Batch.Blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(item.Batch.Blocks))
+	}
+	orphanedHash := chain.blocks[2].Hash
+
+	chain.reorg(2)
+	chain.addEmptyBlocks(3)
+
+	item, _ = next()
+	if item.Error != nil {
+		t.Fatalf("unexpected error during iteration: %v", item.Error)
+	}
+	if diff := cmp.Diff(&arkivevents.Rollback{FirstInvalidBlock: 2}, item.Rollback); diff != "" {
+		t.Fatalf("unexpected rollback (-want +got):\n%s", diff)
+	}
+
+	item, _ = next()
+	if item.Error != nil {
+		t.Fatalf("unexpected error during iteration: %v", item.Error)
+	}
+	numbers := []uint64{}
+	for _, block := range item.Batch.Blocks {
+		numbers = append(numbers, block.Number)
+	}
+	if diff := cmp.Diff([]uint64{2, 3, 4}, numbers); diff != "" {
+		t.Fatalf("unexpected replayed blocks (-want +got):\n%s", diff)
+	}
+	if chain.blocks[2].Hash == orphanedHash {
+		t.Fatalf("expected block 2 to be replaced by the reorg")
+	}
+}
+
+func TestIterateBlocksUnknownBlocks(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(3)
+
+	service := &testEthServiceAhead{eth: &testEthService{chain: chain}}
+	client := newTestClientWithService(t, service)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	t.Run("fresh iterator", func(t *testing.T) {
+		service.ahead.Store(true)
+		defer service.ahead.Store(false)
+
+		items := 0
+		for item := range IterateBlocks(context.Background(), testLogger(), client, 0, WithRetryPolicy(policy)) {
+			items++
+			if !errors.Is(item.Error, errBlockNotFound) {
+				t.Fatalf("expected block not found error, got %+v", item)
+			}
+		}
+		if items != 1 {
+			t.Fatalf("expected a single error, got %d items", items)
+		}
+	})
+
+	t.Run("filled window", func(t *testing.T) {
+		policy := policy
+		policy.MaxAttempts = 100
+
+		next, stop := iter.Pull(iter.Seq[arkivevents.BatchOrError](IterateBlocks(context.Background(), testLogger(), client, 0, WithRetryPolicy(policy))))
+		defer stop()
+
+		item, _ := next()
+		if item.Error != nil || len(item.Batch.Blocks) != 3 {
+			t.Fatalf("expected blocks 1 to 3, got %+v", item)
+		}
+
+		service.ahead.Store(true)
+		defer service.ahead.Store(false)
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			chain.addEmptyBlocks(1)
+		}()
+
+		item, _ = next()
+		if item.Error != nil || item.Rollback != nil || len(item.Batch.Blocks) != 1 || item.Batch.Blocks[0].Number != 4 {
+			t.Fatalf("expected block 4, got %+v", item)
+		}
+	})
+}
+
+func TestIterateBlocksInconsistentChain(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(3)
+
+	client := newTestClientWithService(t, &testEthServiceForked{testEthService: &testEthService{chain: chain}})
+
+	items := 0
+	for item := range IterateBlocks(context.Background(), testLogger(), client, 0,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3}), WithPollInterval(time.Millisecond)) {
+		items++
+		if item.Error == nil || !strings.Contains(item.Error.Error(), "did not form a single chain in 3 attempts") {
+			t.Fatalf("expected an inconsistent chain error, got %+v", item)
+		}
+	}
+	if items != 1 {
+		t.Fatalf("expected a single error, got %d items", items)
+	}
+}
+
+func TestIterateBlocksHeadTracking(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(10)
+	chain.finalized = 4
+	chain.safe = 6
+
+	tests := []struct {
+		name      string
+		opts      []Option
+		lastBlock uint64
+	}{
+		{name: "latest", lastBlock: 10},
+		{name: "confirmations", opts: []Option{WithConfirmations(3)}, lastBlock: 7},
+		{name: "finalized", opts: []Option{WithFinalizedHead()}, lastBlock: 4},
+		{name: "safe", opts: []Option{WithSafeHead()}, lastBlock: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, chain)
+
+			for item := range IterateBlocks(context.Background(), testLogger(), client, 0, tt.opts...) {
+				if item.Error != nil {
+					t.Fatalf("unexpected error during iteration: %v", item.Error)
+				}
+				blocks := item.Batch.Blocks
+				if len(blocks) == 0 || blocks[len(blocks)-1].Number != tt.lastBlock {
+					t.Fatalf("expected first batch to end at block %d, got %v", tt.lastBlock, blocks)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestIterateBlocksNoFinalizedBlock(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(5)
+	chain.finalized = 3
+
+	service := &testEthServiceUnfinalized{testEthService: &testEthService{chain: chain}}
+	client := newTestClientWithService(t, service)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		service.finalized.Store(true)
+	}()
+
+	policy := RetryPolicy{MaxAttempts: 100, InitialBackoff: time.Millisecond}
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0, WithFinalizedHead(), WithRetryPolicy(policy)), 3)
+	if len(blocks) != 3 {
+		t.Fatalf("expected blocks up to the finalized block 3, got %d blocks", len(blocks))
+	}
+}
+
+func TestIteratorOptions(t *testing.T) {
+	processor := common.HexToAddress("0x0000000000000000000000000000000000001234")
+	createdKey := common.HexToHash("0x01")
+
+	createdLog := arkivLog(ArkivEntityCreated, createdKey, common.BytesToHash(testOwner.Bytes()))
+	createdLog.Address = processor
+
+	chain := newTestChain()
+	chain.addEmptyBlocks(2)
+	chain.addBlock(
+		[]RawTransaction{
+			{
+				To:   &processor,
+				From: testOwner,
+				Data: packArkivTransaction(t, &arkivtx.ArkivTransaction{
+					Create: []arkivtx.ArkivCreate{{BTL: 10, ContentType: "text/plain"}},
+				}),
+			},
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 20, ContentType: "text/plain"}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(createdLog),
+			successfulReceipt(),
+		},
+	)
+
+	client := newTestClient(t, chain)
+
+	// Receipts and logs must agree on which logs belong to the processor.
+	for _, logsOnly := range []bool{false, true} {
+		opts := []Option{
+			WithLogger(testLogger()),
+			WithBatchSize(2),
+			WithPollInterval(10 * time.Millisecond),
+			WithProcessorAddress(processor),
+		}
+		if logsOnly {
+			opts = append(opts, WithLogsOnly())
+		}
+		iterator := New(client, opts...)
+
+		batchSizes := []int{}
+		blocks := []events.Block{}
+		for item := range iterator.Iterate(context.Background(), 0) {
+			if item.Error != nil {
+				t.Fatalf("unexpected error during iteration (logs only: %v): %v", logsOnly, item.Error)
+			}
+			batchSizes = append(batchSizes, len(item.Batch.Blocks))
+			blocks = append(blocks, item.Batch.Blocks...)
+			if len(blocks) == 3 {
+				break
+			}
+		}
+
+		if diff := cmp.Diff([]int{2, 1}, batchSizes); diff != "" {
+			t.Fatalf("unexpected batch sizes (logs only: %v) (-want +got):\n%s", logsOnly, diff)
+		}
+
+		operations := blocks[2].Operations
+		if len(operations) != 1 || operations[0].Create == nil || operations[0].Create.BTL != 10 {
+			t.Fatalf("expected a single create sent to the custom processor address (logs only: %v), got %v", logsOnly, operations)
+		}
+	}
+}
+
+func TestIterateBlocksEndBlock(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(10)
+
+	client := newTestClient(t, chain)
+
+	numbers := []uint64{}
+	for item := range IterateBlocks(context.Background(), testLogger(), client, 2, WithEndBlock(7), WithBatchSize(2)) {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		for _, block := range item.Batch.Blocks {
+			numbers = append(numbers, block.Number)
+		}
+	}
+
+	if diff := cmp.Diff([]uint64{3, 4, 5, 6, 7}, numbers); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateBlocksHeadSubscription(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(1)
+
+	client := newTestClient(t, chain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	iterator := New(client, WithLogger(testLogger()), WithPollInterval(time.Hour))
+
+	next, stop := iter.Pull(iter.Seq[arkivevents.BatchOrError](iterator.Iterate(ctx, 0)))
+	defer stop()
+
+	item, ok := next()
+	if !ok || item.Error != nil {
+		t.Fatalf("unexpected end of iteration: %v", item.Error)
+	}
+
+	type result struct {
+		item arkivevents.BatchOrError
+		ok   bool
+	}
+	results := make(chan result, 1)
+	go func() {
+		item, ok := next()
+		results <- result{item: item, ok: ok}
+	}()
+
+	// Give the iterator time to catch up and subscribe before the next block is added.
+	time.Sleep(200 * time.Millisecond)
+	chain.addEmptyBlocks(1)
+
+	r := <-results
+	item = r.item
+	if !r.ok {
+		t.Fatalf("iterator was not woken up by the newHeads subscription")
+	}
+	if item.Error != nil {
+		t.Fatalf("unexpected error during iteration: %v", item.Error)
+	}
+	if len(item.Batch.Blocks) != 1 || item.Batch.Blocks[0].Number != 2 {
+		t.Fatalf("expected block 2, got %v", item.Batch.Blocks)
+	}
+}
+
+func TestIterateBlocksTransactionReceiptsFallback(t *testing.T) {
+	chain := newTestChain()
+
+	createdKey := common.HexToHash("0x01")
+	expiredKey := common.HexToHash("0x02")
+	otherContract := common.HexToAddress("0x0000000000000000000000000000000000004321")
+
+	expiredLog := arkivLog(ArkivEntityExpired, expiredKey, common.BytesToHash(testOwner.Bytes()))
+	expiredLog.Data = expiredKey.Bytes()
+
+	chain.addBlock(
+		[]RawTransaction{
+			{},
+			{To: &otherContract, From: testOwner},
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(expiredLog),
+			successfulReceipt(),
+			successfulReceipt(arkivLog(ArkivEntityCreated, createdKey, common.BytesToHash(testOwner.Bytes()))),
+		},
+	)
+
+	client := newTestClientWithService(t, &testEthServiceWithoutBlockReceipts{eth: &testEthService{chain: chain}})
+
+	iterator := New(client, WithLogger(testLogger()))
+
+	blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 1)
+
+	expired := events.OPExpire{Key: expiredKey, Owner: testOwner}
+	expected := []events.Block{
+		{
+			Number: 1,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Expire: &expired},
+				{TxIndex: 2, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(chain.annotate(expected), blocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+	if !iterator.blockReceiptsUnsupported.Load() {
+		t.Fatalf("expected the iterator to remember that eth_getBlockReceipts is unavailable")
+	}
+}
+
+func TestIterateBlocksExpirationsInAllReceipts(t *testing.T) {
+	chain := newTestChain()
+
+	firstKey := common.HexToHash("0x01")
+	secondKey := common.HexToHash("0x02")
+	foreignKey := common.HexToHash("0x03")
+	createdKey := common.HexToHash("0x04")
+	systemContract := common.HexToAddress("0x0000000000000000000000000000000000004321")
+	owner := common.BytesToHash(testOwner.Bytes())
+
+	// Expiration logs of other contracts are ignored.
+	foreignLog := arkivLog(ArkivEntityExpired, foreignKey, owner)
+	foreignLog.Address = systemContract
+
+	chain.addBlock(
+		[]RawTransaction{
+			{},
+			{To: &systemContract},
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(arkivLog(ArkivEntityExpired, firstKey, owner)),
+			successfulReceipt(foreignLog, arkivLog(ArkivEntityExpired, secondKey, owner)),
+			successfulReceipt(arkivLog(ArkivEntityCreated, createdKey, owner)),
+		},
+	)
+
+	// An Arkiv transaction whose receipt also holds an expiration.
+	mixedExpiredKey := common.HexToHash("0x05")
+	mixedCreatedKey := common.HexToHash("0x06")
+	chain.addBlock(
+		[]RawTransaction{
+			{},
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("mixed")}},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(),
+			successfulReceipt(
+				arkivLog(ArkivEntityExpired, mixedExpiredKey, owner),
+				arkivLog(ArkivEntityCreated, mixedCreatedKey, owner),
+			),
+		},
+	)
+
+	expected := chain.annotate([]events.Block{
+		{
+			Number: 1,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Expire: &events.OPExpire{Key: firstKey, Owner: testOwner}},
+				{TxIndex: 1, OpIndex: 0, Expire: &events.OPExpire{Key: secondKey, Owner: testOwner}},
+				{TxIndex: 2, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+			},
+		},
+		{
+			Number: 2,
+			Operations: []events.Operation{
+				{TxIndex: 1, OpIndex: 0, Expire: &events.OPExpire{Key: mixedExpiredKey, Owner: testOwner}},
+				{TxIndex: 1, OpIndex: 1, Create: &events.OPCreate{
+					Key:               mixedCreatedKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("mixed"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+			},
+		},
+	})
+
+	client := newTestClient(t, chain)
+	clientWithoutBlockReceipts := newTestClientWithService(t, &testEthServiceWithoutBlockReceipts{eth: &testEthService{chain: chain}})
+
+	tests := []struct {
+		name   string
+		client *rpc.Client
+		opts   []Option
+	}{
+		{name: "block receipts", client: client},
+		{name: "transaction receipts", client: clientWithoutBlockReceipts},
+		{name: "logs only", client: client, opts: []Option{WithLogsOnly()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iterator := New(test.client, append([]Option{WithLogger(testLogger())}, test.opts...)...)
+			blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 2)
+			if diff := cmp.Diff(expected, blocks); diff != "" {
+				t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIterateBlocksLogsOnly(t *testing.T) {
+	chain := newTestChain()
+
+	createdKey := common.HexToHash("0x01")
+	deletedKey := common.HexToHash("0x02")
+
+	chain.addEmptyBlocks(2)
+	chain.addBlock(
+		[]RawTransaction{
+			{},
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+			}),
+			arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+				Delete: []common.Hash{deletedKey},
+			}),
+		},
+		[]RawReceipt{
+			successfulReceipt(),
+			successfulReceipt(arkivLog(ArkivEntityCreated, createdKey, common.BytesToHash(testOwner.Bytes()))),
+			successfulReceipt(arkivLog(ArkivEntityDeleted, deletedKey, common.BytesToHash(testOwner.Bytes()))),
+		},
+	)
+	chain.addEmptyBlocks(2)
+
+	client := newTestClient(t, chain)
+
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0, WithLogsOnly()), 5)
+
+	deleted := events.OPDelete{Key: deletedKey, Owner: testOwner}
+	expected := []events.Block{
+		{Number: 1, Operations: []events.Operation{}},
+		{Number: 2, Operations: []events.Operation{}},
+		{
+			Number: 3,
+			Operations: []events.Operation{
+				{TxIndex: 1, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+				{TxIndex: 2, OpIndex: 0, Delete: &deleted},
+			},
+		},
+		{Number: 4, Operations: []events.Operation{}},
+		{Number: 5, Operations: []events.Operation{}},
+	}
+
+	if diff := cmp.Diff(chain.annotate(expected), blocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+	if chain.fetchedFullBlocks() != 1 {
+		t.Fatalf("expected only the block with Arkiv activity to be fetched in full, got %d full block requests", chain.fetchedFullBlocks())
+	}
+}
+
+func TestIterateBlocksLogsOnlyReorgAfterLogs(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(3)
+
+	createdKey := common.HexToHash("0x01")
+
+	// Block 2 gains Arkiv logs after eth_getLogs reported none.
+	service := &testEthServiceReorgAfterLogs{
+		testEthService: &testEthService{chain: chain},
+		reorg: func() {
+			chain.reorg(2)
+			chain.addBlock(
+				[]RawTransaction{
+					{},
+					arkivTransaction(t, testOwner, &arkivtx.ArkivTransaction{
+						Create: []arkivtx.ArkivCreate{{BTL: 100, ContentType: "text/plain", Payload: []byte("hello")}},
+					}),
+				},
+				[]RawReceipt{
+					successfulReceipt(),
+					successfulReceipt(arkivLog(ArkivEntityCreated, createdKey, common.BytesToHash(testOwner.Bytes()))),
+				},
+			)
+			chain.addEmptyBlocks(1)
+		},
+	}
+	client := newTestClientWithService(t, service)
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	blocks := collectBlocks(t, IterateBlocks(context.Background(), testLogger(), client, 0, WithLogsOnly(), WithRetryPolicy(policy)), 3)
+
+	expected := chain.annotate([]events.Block{
+		{Number: 1, Operations: []events.Operation{}},
+		{
+			Number: 2,
+			Operations: []events.Operation{
+				{TxIndex: 1, OpIndex: 0, Create: &events.OPCreate{
+					Key:               createdKey,
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             testOwner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{},
+					NumericAttributes: map[string]uint64{},
+				}},
+			},
+		},
+		{Number: 3, Operations: []events.Operation{}},
+	})
+	if diff := cmp.Diff(expected, blocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateBlocksPrefetch(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(20)
+
+	client := newTestClient(t, chain)
+
+	iterator := New(client, WithLogger(testLogger()), WithBatchSize(3), WithPrefetch(2), WithEndBlock(20))
+
+	next, stop := iter.Pull(iter.Seq[arkivevents.BatchOrError](iterator.Iterate(context.Background(), 0)))
+	defer stop()
+
+	item, ok := next()
+	if !ok || item.Error != nil {
+		t.Fatalf("unexpected end of iteration: %v", item.Error)
+	}
+
+	// While the first batch is consumed, the next two batches are fetched, but no more.
+	deadline := time.Now().Add(5 * time.Second)
+	for fetched := chain.fetchedFullBlocks(); fetched != 9; fetched = chain.fetchedFullBlocks() {
+		if fetched > 9 || time.Now().After(deadline) {
+			t.Fatalf("expected 9 blocks to be fetched ahead, got %d", fetched)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	numbers := []uint64{}
+	for ok {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		for _, block := range item.Batch.Blocks {
+			numbers = append(numbers, block.Number)
+		}
+		item, ok = next()
+	}
+
+	expected := []uint64{}
+	for number := range uint64(20) {
+		expected = append(expected, number+1)
+	}
+	if diff := cmp.Diff(expected, numbers); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateBlocksAdaptiveBatchSize(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(30)
+
+	server := rpc.NewServer()
+	err := server.RegisterName("eth", &testEthService{chain: chain})
+	if err != nil {
+		t.Fatalf("failed to register eth service: %v", err)
+	}
+	// Batches of more than four calls are rejected with "batch too large".
+	server.SetBatchLimits(4, 0)
+	client := rpc.DialInProc(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Stop()
+	})
+
+	iterator := New(client, WithLogger(testLogger()), WithRetryPolicy(NoRetry), WithBatchSize(16), WithAdaptiveBatchSize(1, 64, time.Minute), WithEndBlock(30))
+
+	blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 30)
+	for i, block := range blocks {
+		if block.Number != uint64(i+1) {
+			t.Fatalf("expected block %d, got %d", i+1, block.Number)
+		}
+	}
+	if len(blocks) != 30 {
+		t.Fatalf("expected 30 blocks, got %d", len(blocks))
+	}
+	if size := iterator.BatchSize(); size > 4 {
+		t.Fatalf("expected the batch size to shrink to at most 4, got %d", size)
+	}
+
+	// Without adaptive sizing, the oversized batch surfaces as an error.
+	iterator = New(client, WithLogger(testLogger()), WithRetryPolicy(NoRetry), WithBatchSize(16), WithEndBlock(30))
+	for item := range iterator.Iterate(context.Background(), 0) {
+		if item.Error == nil {
+			t.Fatalf("expected a batch too large error, got %d blocks", len(item.Batch.Blocks))
+		}
+		if !isBatchTooLarge(item.Error) {
+			t.Fatalf("expected a batch too large error, got %v", item.Error)
+		}
+	}
+}
+
+func TestIterateBlocksAdaptiveBatchSizeGrows(t *testing.T) {
+	chain := newTestChain()
+	chain.addEmptyBlocks(100)
+
+	client := newTestClient(t, chain)
+
+	iterator := New(client, WithLogger(testLogger()), WithBatchSize(2), WithAdaptiveBatchSize(1, 16, time.Minute), WithEndBlock(100))
+
+	blocks := collectBlocks(t, iterator.Iterate(context.Background(), 0), 100)
+	if len(blocks) != 100 {
+		t.Fatalf("expected 100 blocks, got %d", len(blocks))
+	}
+	if size := iterator.BatchSize(); size != 16 {
+		t.Fatalf("expected the batch size to grow to 16, got %d", size)
+	}
+}
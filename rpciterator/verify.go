@@ -0,0 +1,130 @@
+package rpciterator
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// VerificationMode selects how the iterator handles Arkiv operations that do not
+// match the logs of their transaction's receipt.
+type VerificationMode int
+
+const (
+	// VerifyStrict ends the iteration with a *MismatchError on the first mismatch.
+	VerifyStrict VerificationMode = iota
+	// VerifyLenient logs mismatches as warnings and skips operations without a matching log.
+	VerifyLenient
+)
+
+// MismatchError reports an Arkiv operation without a matching receipt log, or
+// a receipt log without a matching operation.
+type MismatchError struct {
+	BlockNumber uint64
+	TxIndex     uint64
+	TxHash      common.Hash
+	// Operation is the kind of operation: create, update, delete, extend_btl or change_owner.
+	Operation string
+	// OpIndex is the position of the operation in the transaction, as in events.Operation.
+	// It is -1 for logs without a matching operation.
+	OpIndex   int
+	EntityKey common.Hash
+	Reason    string
+}
+
+func (e *MismatchError) Error() string {
+	if e.OpIndex < 0 {
+		return fmt.Sprintf("block %d tx %d (%s): %s log of entity %s: %s", e.BlockNumber, e.TxIndex, e.TxHash, e.Operation, e.EntityKey, e.Reason)
+	}
+	return fmt.Sprintf("block %d tx %d (%s): %s operation %d of entity %s: %s", e.BlockNumber, e.TxIndex, e.TxHash, e.Operation, e.OpIndex, e.EntityKey, e.Reason)
+}
+
+// operationEvents maps the kinds of operations to the events emitted for them.
+var operationEvents = map[common.Hash]string{
+	ArkivEntityCreated:      "create",
+	ArkivEntityUpdated:      "update",
+	ArkivEntityDeleted:      "delete",
+	ArkivEntityBTLExtended:  "extend_btl",
+	ArkivEntityOwnerChanged: "change_owner",
+}
+
+// receiptLogs hands out the logs of a receipt to the operations they were emitted
+// for. Created entity logs are matched by order, as the entity key is only known
+// from the log; all other logs are matched by event and entity key.
+type receiptLogs struct {
+	created  []types.Log
+	byEntity map[common.Hash]map[common.Hash][]types.Log
+}
+
+// newReceiptLogs collects the operation logs of receipt emitted by the processor address.
+func (it *Iterator) newReceiptLogs(receipt RawReceipt) *receiptLogs {
+	logs := &receiptLogs{
+		created:  []types.Log{},
+		byEntity: map[common.Hash]map[common.Hash][]types.Log{},
+	}
+	for _, log := range receipt.Logs {
+		if log.Address != it.opts.processorAddress || len(log.Topics) < 2 {
+			continue
+		}
+		event := log.Topics[0]
+		if _, ok := operationEvents[event]; !ok {
+			continue
+		}
+		if event == ArkivEntityCreated {
+			logs.created = append(logs.created, log)
+			continue
+		}
+		if logs.byEntity[event] == nil {
+			logs.byEntity[event] = map[common.Hash][]types.Log{}
+		}
+		logs.byEntity[event][log.Topics[1]] = append(logs.byEntity[event][log.Topics[1]], log)
+	}
+	return logs
+}
+
+// nextCreated removes and returns the first remaining created entity log.
+func (l *receiptLogs) nextCreated() (types.Log, bool) {
+	if len(l.created) == 0 {
+		return types.Log{}, false
+	}
+	log := l.created[0]
+	l.created = l.created[1:]
+	return log, true
+}
+
+// next removes and returns the first remaining log of the event for the entity.
+func (l *receiptLogs) next(event common.Hash, entityKey common.Hash) (types.Log, bool) {
+	entityLogs := l.byEntity[event][entityKey]
+	if len(entityLogs) == 0 {
+		return types.Log{}, false
+	}
+	l.byEntity[event][entityKey] = entityLogs[1:]
+	return entityLogs[0], true
+}
+
+// unmatched returns the logs that were not handed out to any operation.
+func (l *receiptLogs) unmatched() []types.Log {
+	logs := append([]types.Log{}, l.created...)
+	for _, byEntity := range l.byEntity {
+		for _, entityLogs := range byEntity {
+			logs = append(logs, entityLogs...)
+		}
+	}
+	slices.SortFunc(logs, func(a, b types.Log) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	return logs
+}
+
+// mismatch handles a MismatchError according to the verification mode. It returns
+// the error in strict mode, and logs it and returns nil in lenient mode.
+func (it *Iterator) mismatch(err *MismatchError) error {
+	if it.opts.verification == VerifyStrict {
+		return err
+	}
+	it.log.Warn("skipping arkiv operation not matching its receipt", "error", err)
+	return nil
+}
@@ -0,0 +1,94 @@
+package tariterator
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+)
+
+// IndexEntry locates the entry of a block in an archive.
+type IndexEntry struct {
+	Block uint64 `json:"block"`
+	// Offset is the byte offset of the entry's tar header from the start of the archive.
+	Offset int64 `json:"offset"`
+}
+
+// Index maps the blocks of an archive to the offsets of their entries, so that
+// IterateTarFrom can start reading at any block without scanning the archive.
+// It is stored as a JSON sidecar file next to the archive, see WithIndex.
+type Index struct {
+	Entries []IndexEntry `json:"entries"`
+}
+
+// ReadIndex decodes an index written by a Writer created WithIndex.
+func ReadIndex(r io.Reader) (*Index, error) {
+	index := &Index{}
+	err := json.NewDecoder(r).Decode(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	if !slices.IsSortedFunc(index.Entries, func(a, b IndexEntry) int {
+		return cmp.Compare(a.Block, b.Block)
+	}) {
+		return nil, fmt.Errorf("index entries are not sorted by block")
+	}
+	return index, nil
+}
+
+// Write encodes the index as JSON to w.
+func (idx *Index) Write(w io.Writer) error {
+	err := json.NewEncoder(w).Encode(idx)
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	return nil
+}
+
+// Lookup returns the offset of the entry of the first block at or after startBlock.
+// It reports false if the archive has no such block.
+func (idx *Index) Lookup(startBlock uint64) (int64, bool) {
+	i, _ := slices.BinarySearchFunc(idx.Entries, startBlock, func(entry IndexEntry, block uint64) int {
+		return cmp.Compare(entry.Block, block)
+	})
+	if i == len(idx.Entries) {
+		return 0, false
+	}
+	return idx.Entries[i].Offset, true
+}
+
+// IterateTarFrom yields the blocks from startBlock onwards stored in the archive
+// read by r, in batches of batchSize blocks. With an index, reading starts at the
+// entry of startBlock. Without an index, the archive is scanned from the start,
+// skipping the entries of earlier blocks without decompressing them. If the
+// options include WithBlockRange, the later of its start and startBlock applies.
+func IterateTarFrom(batchSize int, r io.ReadSeeker, index *Index, startBlock uint64, opts ...Option) arkivevents.BatchIterator {
+	o := newOptions(opts)
+	o.fromBlock = max(o.fromBlock, startBlock)
+
+	return func(yield func(arkivevents.BatchOrError) bool) {
+		offset := int64(0)
+		if index != nil {
+			var ok bool
+			offset, ok = index.Lookup(o.fromBlock)
+			if !ok {
+				return
+			}
+		}
+
+		_, err := r.Seek(offset, io.SeekStart)
+		if err != nil {
+			yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to seek to offset %d: %w", offset, err)})
+			return
+		}
+
+		for item := range iterateTar(batchSize, r, o) {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package tariterator
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/go-cmp/cmp"
+)
+
+// countingReadSeeker counts the bytes read through it.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.read += n
+	return n, err
+}
+
+func blockNumbers(blocks []events.Block) []uint64 {
+	numbers := []uint64{}
+	for _, block := range blocks {
+		numbers = append(numbers, block.Number)
+	}
+	return numbers
+}
+
+func TestIterateTarFrom(t *testing.T) {
+	var archive, indexFile bytes.Buffer
+	writer, err := NewWriter(&archive, WithIndex(&indexFile))
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for number := uint64(2); number <= 40; number += 2 {
+		err = writer.WriteBlock(events.Block{
+			Number: number,
+			Operations: []events.Operation{
+				{Expire: &events.OPExpire{Key: common.BigToHash(new(big.Int).SetUint64(number))}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	index, err := ReadIndex(&indexFile)
+	if err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+	if diff := cmp.Diff(writer.Index(), index); diff != "" {
+		t.Fatalf("unexpected index (-want +got):\n%s", diff)
+	}
+
+	collect := func(index *Index, startBlock uint64) ([]uint64, int) {
+		t.Helper()
+		reader := &countingReadSeeker{ReadSeeker: bytes.NewReader(archive.Bytes())}
+		blocks := []events.Block{}
+		for item := range IterateTarFrom(3, reader, index, startBlock) {
+			if item.Error != nil {
+				t.Fatalf("unexpected error during iteration: %v", item.Error)
+			}
+			blocks = append(blocks, item.Batch.Blocks...)
+		}
+		return blockNumbers(blocks), reader.read
+	}
+
+	expected := []uint64{32, 34, 36, 38, 40}
+
+	indexed, indexedRead := collect(index, 31)
+	if diff := cmp.Diff(expected, indexed); diff != "" {
+		t.Fatalf("unexpected blocks with index (-want +got):\n%s", diff)
+	}
+
+	scanned, scannedRead := collect(nil, 31)
+	if diff := cmp.Diff(expected, scanned); diff != "" {
+		t.Fatalf("unexpected blocks without index (-want +got):\n%s", diff)
+	}
+
+	if indexedRead >= scannedRead {
+		t.Fatalf("expected the index to skip reading earlier blocks, read %d bytes with and %d without", indexedRead, scannedRead)
+	}
+
+	beyond, _ := collect(index, 41)
+	if len(beyond) != 0 {
+		t.Fatalf("expected no blocks after the last block, got %v", beyond)
+	}
+}
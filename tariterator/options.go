@@ -0,0 +1,44 @@
+package tariterator
+
+import "math"
+
+// Option configures how an archive is read.
+type Option func(*options)
+
+type options struct {
+	// workers is the number of goroutines decoding block entries.
+	workers int
+	// fromBlock and toBlock bound the blocks that are yielded, inclusively.
+	fromBlock uint64
+	toBlock   uint64
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		workers: 1,
+		toBlock: math.MaxUint64,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithWorkers makes n goroutines decompress and decode block entries in parallel.
+// Entries are still read sequentially and blocks are yielded in archive order.
+// It defaults to 1, decoding every entry on the iterating goroutine.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = max(n, 1)
+	}
+}
+
+// WithBlockRange only yields the blocks from fromBlock to toBlock, inclusively.
+// Entries outside the range are skipped by their names, without decompressing
+// them, and reading stops at the first entry after toBlock.
+func WithBlockRange(fromBlock, toBlock uint64) Option {
+	return func(o *options) {
+		o.fromBlock = fromBlock
+		o.toBlock = toBlock
+	}
+}
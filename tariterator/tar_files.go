@@ -0,0 +1,163 @@
+package tariterator
+
+import (
+	"archive/tar"
+	"cmp"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+)
+
+// archiveRange is the range of blocks stored in an archive file.
+type archiveRange struct {
+	path  string
+	first uint64
+	last  uint64
+}
+
+// IterateTarDir yields the blocks of all archives in dir, the files with a .tar
+// extension, as one continuous iteration. See IterateTarFiles.
+func IterateTarDir(batchSize int, dir string, opts ...Option) arkivevents.BatchIterator {
+	return func(yield func(arkivevents.BatchOrError) bool) {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+		if err != nil {
+			yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to list archives in %s: %w", dir, err)})
+			return
+		}
+
+		for item := range IterateTarFiles(batchSize, paths, opts...) {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+// IterateTarFiles yields the blocks of the given archives as one continuous
+// iteration, in batches of batchSize blocks that may span archives. The archives
+// are ordered by the blocks they hold, regardless of the order of paths, and must
+// cover a contiguous range: every archive has to start at the block after the last
+// block of the previous one. Otherwise an error is yielded before any block.
+// Archives without entries are skipped, as are archives outside the range set
+// by WithBlockRange.
+func IterateTarFiles(batchSize int, paths []string, opts ...Option) arkivevents.BatchIterator {
+	o := newOptions(opts)
+
+	return func(yield func(arkivevents.BatchOrError) bool) {
+		ranges := []archiveRange{}
+		for _, path := range paths {
+			r, ok, err := readArchiveRange(path)
+			if err != nil {
+				yield(arkivevents.BatchOrError{Error: err})
+				return
+			}
+			if ok {
+				ranges = append(ranges, r)
+			}
+		}
+
+		slices.SortFunc(ranges, func(a, b archiveRange) int {
+			return cmp.Compare(a.first, b.first)
+		})
+
+		for i := 1; i < len(ranges); i++ {
+			previous, current := ranges[i-1], ranges[i]
+			if current.first <= previous.last {
+				yield(arkivevents.BatchOrError{Error: fmt.Errorf("archive %s (blocks %d-%d) overlaps archive %s (blocks %d-%d)", current.path, current.first, current.last, previous.path, previous.first, previous.last)})
+				return
+			}
+			if current.first != previous.last+1 {
+				yield(arkivevents.BatchOrError{Error: fmt.Errorf("blocks %d-%d are missing between archive %s and archive %s", previous.last+1, current.first-1, previous.path, current.path)})
+				return
+			}
+		}
+
+		ranges = slices.DeleteFunc(ranges, func(r archiveRange) bool {
+			return r.last < o.fromBlock || r.first > o.toBlock
+		})
+
+		for item := range batchBlocks(batchSize, decodeArchives(ranges, o)) {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+// decodeArchives decodes the blocks of the archives one after another.
+func decodeArchives(ranges []archiveRange, o options) iter.Seq[blockOrError] {
+	return func(yield func(blockOrError) bool) {
+		for _, r := range ranges {
+			if !decodeArchive(r.path, o, yield) {
+				return
+			}
+		}
+	}
+}
+
+// decodeArchive yields the blocks of the archive at path. It reports whether
+// the iteration should continue with the next archive.
+func decodeArchive(path string, o options, yield func(blockOrError) bool) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		yield(blockOrError{err: fmt.Errorf("failed to open archive: %w", err)})
+		return false
+	}
+	defer file.Close()
+
+	for decoded := range decodeTar(tar.NewReader(file), o) {
+		if decoded.err != nil {
+			yield(blockOrError{err: fmt.Errorf("archive %s: %w", path, decoded.err)})
+			return false
+		}
+		if !yield(decoded) {
+			return false
+		}
+	}
+	return true
+}
+
+// readArchiveRange reads the first and last block of the archive at path from
+// its entry names. It reports false if the archive has no entries.
+func readArchiveRange(path string) (archiveRange, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return archiveRange{}, false, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	r := archiveRange{path: path}
+	found := false
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archiveRange{}, false, fmt.Errorf("failed to read tar header of archive %s: %w", path, err)
+		}
+
+		blockNumber := blockNumberRegex.FindStringSubmatch(header.Name)
+		if len(blockNumber) == 0 {
+			return archiveRange{}, false, fmt.Errorf("failed to find block number in filename %s of archive %s", header.Name, path)
+		}
+		blockNumberInt, err := strconv.ParseUint(blockNumber[1], 10, 64)
+		if err != nil {
+			return archiveRange{}, false, fmt.Errorf("failed to parse block number %s of archive %s: %w", blockNumber[1], path, err)
+		}
+
+		if !found {
+			r.first = blockNumberInt
+			found = true
+		}
+		r.last = blockNumberInt
+	}
+	return r, found, nil
+}
@@ -0,0 +1,115 @@
+package tariterator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeArchive writes blocks first to last, without operations, to an archive at path.
+func writeArchive(t *testing.T, path string, first, last uint64) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	defer file.Close()
+
+	writer, err := NewWriter(file)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for number := first; number <= last; number++ {
+		err = writer.WriteBlock(events.Block{Number: number, Operations: []events.Operation{}})
+		if err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+}
+
+func TestIterateTarDir(t *testing.T) {
+	dir := t.TempDir()
+	writeArchive(t, filepath.Join(dir, "a.tar"), 20, 24)
+	writeArchive(t, filepath.Join(dir, "b.tar"), 10, 14)
+	writeArchive(t, filepath.Join(dir, "c.tar"), 15, 19)
+	writeArchive(t, filepath.Join(dir, "empty.tar"), 1, 0)
+	err := os.WriteFile(filepath.Join(dir, "index.json"), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for _, workers := range []int{1, 3} {
+		batches := [][]uint64{}
+		for item := range IterateTarDir(4, dir, WithWorkers(workers)) {
+			if item.Error != nil {
+				t.Fatalf("unexpected error during iteration: %v", item.Error)
+			}
+			batches = append(batches, blockNumbers(item.Batch.Blocks))
+		}
+
+		expected := [][]uint64{
+			{10, 11, 12, 13},
+			{14, 15, 16, 17},
+			{18, 19, 20, 21},
+			{22, 23, 24},
+		}
+		if diff := cmp.Diff(expected, batches); diff != "" {
+			t.Fatalf("unexpected batches with %d workers (-want +got):\n%s", workers, diff)
+		}
+	}
+
+	blocks := []events.Block{}
+	for item := range IterateTarDir(4, dir, WithBlockRange(16, 21)) {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		blocks = append(blocks, item.Batch.Blocks...)
+	}
+	if diff := cmp.Diff([]uint64{16, 17, 18, 19, 20, 21}, blockNumbers(blocks)); diff != "" {
+		t.Fatalf("unexpected blocks in range (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateTarFilesRanges(t *testing.T) {
+	dir := t.TempDir()
+	writeArchive(t, filepath.Join(dir, "a.tar"), 10, 14)
+	writeArchive(t, filepath.Join(dir, "b.tar"), 14, 18)
+	writeArchive(t, filepath.Join(dir, "c.tar"), 16, 20)
+
+	tests := []struct {
+		name  string
+		paths []string
+		err   string
+	}{
+		{name: "overlap", paths: []string{"a.tar", "b.tar"}, err: "overlaps"},
+		{name: "gap", paths: []string{"c.tar", "a.tar"}, err: "blocks 15-15 are missing"},
+		{name: "missing file", paths: []string{"a.tar", "d.tar"}, err: "failed to open archive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := []string{}
+			for _, path := range tt.paths {
+				paths = append(paths, filepath.Join(dir, path))
+			}
+
+			var items int
+			var iterErr error
+			for item := range IterateTarFiles(4, paths) {
+				items++
+				iterErr = item.Error
+			}
+			if items != 1 || iterErr == nil || !strings.Contains(iterErr.Error(), tt.err) {
+				t.Fatalf("expected a single error containing %q, got %d items and error %v", tt.err, items, iterErr)
+			}
+		})
+	}
+}
@@ -2,104 +2,294 @@ package tariterator
 
 import (
 	"archive/tar"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"iter"
 	"regexp"
 	"strconv"
+	"sync"
 
 	arkivevents "github.com/Arkiv-Network/arkiv-events"
 	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/klauspost/compress/zstd"
 )
 
 var blockNumberRegex = regexp.MustCompile(`^block-(\d+).json.zst$`)
 
-func IterateTar(batchSize int, tarFileReader io.Reader) arkivevents.BatchIterator {
+// BlockHeader is the block metadata stored in an archive. It is written as
+// {"block_header": {...}}, the first JSON value of a block's entry, ahead of the
+// block's operations. Archives written before block metadata was added lack the
+// record; their blocks are read without hash, parent hash and timestamp.
+type BlockHeader struct {
+	Hash       common.Hash `json:"hash"`
+	ParentHash common.Hash `json:"parent_hash"`
+	Timestamp  uint64      `json:"timestamp"`
+}
+
+// record is a JSON value of a block's entry: either the block header or an operation.
+type record struct {
+	BlockHeader *BlockHeader `json:"block_header,omitempty"`
+	events.Operation
+}
+
+// IterateTar yields the blocks stored in a tar archive in batches of batchSize blocks.
+// Every block is an entry named block-<number>.json.zst holding a zstd-compressed
+// stream of JSON values: an optional BlockHeader record followed by the block's operations.
+func IterateTar(batchSize int, tarFileReader io.Reader, opts ...Option) arkivevents.BatchIterator {
+	return iterateTar(batchSize, tarFileReader, newOptions(opts))
+}
+
+// blockOrError is a decoded block or the error that ended decoding.
+type blockOrError struct {
+	block events.Block
+	err   error
+}
 
+// iterateTar yields the blocks in the range of o. Entries outside the range
+// are skipped by their names, without decompressing them.
+func iterateTar(batchSize int, tarFileReader io.Reader, o options) arkivevents.BatchIterator {
 	return func(yield func(arkivevents.BatchOrError) bool) {
-		eventsReader, err := zstd.NewReader(nil)
-		if err != nil {
-			yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to create zstd reader: %w", err)})
-			return
+		for item := range batchBlocks(batchSize, decodeTar(tar.NewReader(tarFileReader), o)) {
+			if !yield(item) {
+				return
+			}
 		}
-		defer eventsReader.Close()
+	}
+}
 
-		tarReader := tar.NewReader(tarFileReader)
+// decodeTar yields the blocks of the entries in the range of o, decoded
+// serially or by the configured number of workers.
+func decodeTar(tarReader *tar.Reader, o options) iter.Seq[blockOrError] {
+	entries := blockEntries(tarReader, o.fromBlock, o.toBlock)
+	if o.workers > 1 {
+		return decodeEntriesInParallel(tarReader, entries, o.workers)
+	}
+	return decodeEntries(tarReader, entries)
+}
 
+// batchBlocks groups blocks into batches of batchSize blocks. It stops at the
+// first error, after yielding it.
+func batchBlocks(batchSize int, blocks iter.Seq[blockOrError]) arkivevents.BatchIterator {
+	return func(yield func(arkivevents.BatchOrError) bool) {
 		batch := arkivevents.BatchOrError{
 			Batch: events.BlockBatch{
 				Blocks: []events.Block{},
 			},
 		}
 
+		for decoded := range blocks {
+			if decoded.err != nil {
+				yield(arkivevents.BatchOrError{Error: decoded.err})
+				return
+			}
+			batch.Batch.Blocks = append(batch.Batch.Blocks, decoded.block)
+
+			if len(batch.Batch.Blocks) >= batchSize {
+				if !yield(arkivevents.BatchOrError{Batch: batch.Batch}) {
+					return
+				}
+				batch = arkivevents.BatchOrError{
+					Batch: events.BlockBatch{
+						Blocks: []events.Block{},
+					},
+				}
+			}
+		}
+
+		if len(batch.Batch.Blocks) > 0 {
+			if !yield(arkivevents.BatchOrError{Batch: batch.Batch}) {
+				return
+			}
+		}
+
+	}
+}
+
+// blockEntries yields the block number of every entry from fromBlock to toBlock.
+// The entry's content is read from tarReader before continuing the iteration.
+// As entries are written in block order, it stops at the first entry after toBlock.
+func blockEntries(tarReader *tar.Reader, fromBlock, toBlock uint64) iter.Seq2[uint64, error] {
+	return func(yield func(uint64, error) bool) {
 		for {
 			header, err := tarReader.Next()
 			if err == io.EOF {
-				break
+				return
 			}
 			if err != nil {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to read tar header: %w", err)})
+				yield(0, fmt.Errorf("failed to read tar header: %w", err))
 				return
 			}
 
 			blockNumber := blockNumberRegex.FindStringSubmatch(header.Name)
 			if len(blockNumber) == 0 {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to find block number in filename %s of tar header: %w", header.Name, err)})
+				yield(0, fmt.Errorf("failed to find block number in filename %s of tar header", header.Name))
 				return
 			}
 
 			blockNumberInt, err := strconv.ParseUint(blockNumber[1], 10, 64)
 			if err != nil {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to parse block number %s: %w", blockNumber[1], err)})
+				yield(0, fmt.Errorf("failed to parse block number %s: %w", blockNumber[1], err))
 				return
 			}
 
-			err = eventsReader.Reset(tarReader)
-			if err != nil {
-				yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to reset zstd reader: %w", err)})
+			if blockNumberInt < fromBlock {
+				continue
+			}
+			if blockNumberInt > toBlock {
 				return
 			}
 
-			decoder := json.NewDecoder(eventsReader)
-			decoder.DisallowUnknownFields()
+			if !yield(blockNumberInt, nil) {
+				return
+			}
+		}
+	}
+}
+
+// decodeEntries decodes the block entries one after another.
+func decodeEntries(tarReader *tar.Reader, entries iter.Seq2[uint64, error]) iter.Seq[blockOrError] {
+	return func(yield func(blockOrError) bool) {
+		eventsReader, err := zstd.NewReader(nil)
+		if err != nil {
+			yield(blockOrError{err: fmt.Errorf("failed to create zstd reader: %w", err)})
+			return
+		}
+		defer eventsReader.Close()
 
-			block := events.Block{
-				Number:     blockNumberInt,
-				Operations: []events.Operation{},
+		for blockNumber, err := range entries {
+			if err != nil {
+				yield(blockOrError{err: err})
+				return
 			}
+			block, err := decodeBlock(eventsReader, blockNumber, tarReader)
+			if !yield(blockOrError{block: block, err: err}) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// decodeEntriesInParallel reads the block entries sequentially and decodes them
+// with the given number of workers. Blocks are yielded in archive order; up to
+// two entries per worker are held in memory ahead of the block being yielded.
+func decodeEntriesInParallel(tarReader *tar.Reader, entries iter.Seq2[uint64, error], workers int) iter.Seq[blockOrError] {
+	return func(yield func(blockOrError) bool) {
+		type job struct {
+			blockNumber uint64
+			content     []byte
+			result      chan blockOrError
+		}
+
+		done := make(chan struct{})
+		jobs := make(chan job)
+		pending := make(chan chan blockOrError, 2*workers)
+
+		var wg sync.WaitGroup
+		defer func() {
+			close(done)
+			wg.Wait()
+		}()
+
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				eventsReader, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+				if err != nil {
+					for job := range jobs {
+						job.result <- blockOrError{err: fmt.Errorf("failed to create zstd reader: %w", err)}
+					}
+					return
+				}
+				defer eventsReader.Close()
 
-			for {
-				operation := events.Operation{}
-				err = decoder.Decode(&operation)
-				if err == io.EOF {
-					break
+				for job := range jobs {
+					block, err := decodeBlock(eventsReader, job.blockNumber, bytes.NewReader(job.content))
+					job.result <- blockOrError{block: block, err: err}
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(pending)
+			defer close(jobs)
+
+			for blockNumber, err := range entries {
+				result := make(chan blockOrError, 1)
+				select {
+				case pending <- result:
+				case <-done:
+					return
 				}
 				if err != nil {
-					yield(arkivevents.BatchOrError{Error: fmt.Errorf("failed to decode operation: %w", err)})
+					result <- blockOrError{err: err}
 					return
 				}
-				block.Operations = append(block.Operations, operation)
-			}
-			batch.Batch.Blocks = append(batch.Batch.Blocks, block)
 
-			if len(batch.Batch.Blocks) >= batchSize {
-				if !yield(arkivevents.BatchOrError{Batch: batch.Batch}) {
+				content, err := io.ReadAll(tarReader)
+				if err != nil {
+					result <- blockOrError{err: fmt.Errorf("failed to read entry of block %d: %w", blockNumber, err)}
 					return
 				}
-				batch = arkivevents.BatchOrError{
-					Batch: events.BlockBatch{
-						Blocks: []events.Block{},
-					},
+
+				select {
+				case jobs <- job{blockNumber: blockNumber, content: content, result: result}:
+				case <-done:
+					return
 				}
 			}
-		}
+		}()
 
-		if len(batch.Batch.Blocks) > 0 {
-			if !yield(arkivevents.BatchOrError{Batch: batch.Batch}) {
+		for result := range pending {
+			decoded := <-result
+			if !yield(decoded) || decoded.err != nil {
 				return
 			}
 		}
+	}
+}
+
+// decodeBlock decodes the zstd-compressed content of the entry of the given block.
+func decodeBlock(eventsReader *zstd.Decoder, blockNumber uint64, content io.Reader) (events.Block, error) {
+	err := eventsReader.Reset(content)
+	if err != nil {
+		return events.Block{}, fmt.Errorf("failed to reset zstd reader: %w", err)
+	}
+
+	decoder := json.NewDecoder(eventsReader)
+	decoder.DisallowUnknownFields()
+
+	block := events.Block{
+		Number:     blockNumber,
+		Operations: []events.Operation{},
+	}
 
+	for i := 0; ; i++ {
+		record := record{}
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return events.Block{}, fmt.Errorf("failed to decode operation: %w", err)
+		}
+		if record.BlockHeader != nil {
+			if i != 0 {
+				return events.Block{}, fmt.Errorf("block header of block %d is not the first record", blockNumber)
+			}
+			block.Hash = record.BlockHeader.Hash
+			block.ParentHash = record.BlockHeader.ParentHash
+			block.Timestamp = record.BlockHeader.Timestamp
+			continue
+		}
+		record.Operation.Sequence = uint64(len(block.Operations))
+		block.Operations = append(block.Operations, record.Operation)
 	}
+
+	return block, nil
 }
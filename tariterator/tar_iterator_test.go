@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"testing"
 
 	"github.com/Arkiv-Network/arkiv-events/events"
@@ -14,6 +15,9 @@ import (
 )
 
 func TestIterateTar(t *testing.T) {
+	deleted := events.OPDelete{Key: common.HexToHash("0x1234567890123456789012345678901234567890"), Owner: common.HexToAddress("0x1234567890123456789012345678901234567890")}
+	expired := events.OPExpire{Key: common.HexToHash("0x1234567890123456789012345678901234567891")}
+
 	// Create test blocks with operations
 	testBlocks := []events.Block{
 		{
@@ -36,6 +40,8 @@ func TestIterateTar(t *testing.T) {
 					Content:           []byte("Hello, world!"),
 					StringAttributes:  map[string]string{"key": "value"},
 					NumericAttributes: map[string]uint64{"key": 100},
+					ExpirationBlock:   202,
+					Cost:              big.NewInt(1_000_000_000),
 				}},
 			},
 		},
@@ -63,7 +69,10 @@ func TestIterateTar(t *testing.T) {
 			},
 		},
 		{
-			Number: 102,
+			Number:     102,
+			Hash:       common.HexToHash("0x0102"),
+			ParentHash: common.HexToHash("0x0101"),
+			Timestamp:  1700000204,
 			Operations: []events.Operation{
 				{TxIndex: 0, OpIndex: 0, Update: &events.OPUpdate{
 					Key:               common.HexToHash("0x1234567890123456789012345678901234567890"),
@@ -94,6 +103,22 @@ func TestIterateTar(t *testing.T) {
 				}},
 			},
 		},
+		{
+			Number:     103,
+			Hash:       common.HexToHash("0x0103"),
+			ParentHash: common.HexToHash("0x0102"),
+			Timestamp:  1700000206,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Expire: &expired},
+				{
+					TxIndex: 1,
+					OpIndex: 0,
+					TxHash:  common.HexToHash("0x0103ff"),
+					From:    common.HexToAddress("0x1234567890123456789012345678901234567890"),
+					Delete:  &deleted,
+				},
+			},
+		},
 	}
 
 	// Build tar file in memory
@@ -110,6 +135,18 @@ func TestIterateTar(t *testing.T) {
 
 		encoder := json.NewEncoder(zstdWriter)
 
+		// Blocks without a hash are written like archives predating block headers.
+		if block.Hash != (common.Hash{}) {
+			err := encoder.Encode(map[string]BlockHeader{"block_header": {
+				Hash:       block.Hash,
+				ParentHash: block.ParentHash,
+				Timestamp:  block.Timestamp,
+			}})
+			if err != nil {
+				t.Fatalf("failed to encode block header: %v", err)
+			}
+		}
+
 		// Write operations as separate JSON objects
 		for _, op := range block.Operations {
 			err := encoder.Encode(op)
@@ -125,7 +162,7 @@ func TestIterateTar(t *testing.T) {
 
 		// Write tar entry
 		header := &tar.Header{
-			Name: fmt.Sprintf("block-%020d.tar.zst", block.Number),
+			Name: fmt.Sprintf("block-%020d.json.zst", block.Number),
 			Size: int64(zstdBuffer.Len()),
 			Mode: 0644,
 		}
@@ -147,6 +184,13 @@ func TestIterateTar(t *testing.T) {
 		t.Fatalf("failed to close tar writer: %v", err)
 	}
 
+	// Operations are read with their position in the block as sequence.
+	for _, block := range testBlocks {
+		for i := range block.Operations {
+			block.Operations[i].Sequence = uint64(i)
+		}
+	}
+
 	// Iterate using IterateTar
 	iterator := IterateTar(3, &tarBuffer)
 
@@ -163,8 +207,215 @@ func TestIterateTar(t *testing.T) {
 		t.Fatalf("expected %d blocks, got %d", len(testBlocks), len(resultBlocks))
 	}
 
-	if !cmp.Equal(resultBlocks, testBlocks) {
+	if !cmp.Equal(resultBlocks, testBlocks, cmp.Comparer(func(a, b *big.Int) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && a.Cmp(b) == 0)
+	})) {
 		t.Fatalf("expected %v, got %v", testBlocks, resultBlocks)
 	}
 
 }
+
+// writeBlockEntry adds a block entry with the given uncompressed content to the archive.
+func writeBlockEntry(t *testing.T, tarWriter *tar.Writer, number uint64, content []byte) {
+	t.Helper()
+
+	var zstdBuffer bytes.Buffer
+	zstdWriter, err := zstd.NewWriter(&zstdBuffer)
+	if err != nil {
+		t.Fatalf("failed to create zstd writer: %v", err)
+	}
+	_, err = zstdWriter.Write(content)
+	if err != nil {
+		t.Fatalf("failed to compress block content: %v", err)
+	}
+	err = zstdWriter.Close()
+	if err != nil {
+		t.Fatalf("failed to close zstd writer: %v", err)
+	}
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name: fmt.Sprintf("block-%020d.json.zst", number),
+		Size: int64(zstdBuffer.Len()),
+		Mode: 0644,
+	})
+	if err != nil {
+		t.Fatalf("failed to write tar header: %v", err)
+	}
+	_, err = tarWriter.Write(zstdBuffer.Bytes())
+	if err != nil {
+		t.Fatalf("failed to write tar content: %v", err)
+	}
+}
+
+func TestIterateTarLegacyEntityKeys(t *testing.T) {
+	expiredKey := common.HexToHash("0x01")
+	deletedKey := common.HexToHash("0x02")
+
+	// Archives written before owners were recorded hold bare keys as arrays of bytes.
+	legacyExpire, err := json.Marshal([common.HashLength]byte(expiredKey))
+	if err != nil {
+		t.Fatalf("failed to encode legacy key: %v", err)
+	}
+	legacyDelete, err := json.Marshal([common.HashLength]byte(deletedKey))
+	if err != nil {
+		t.Fatalf("failed to encode legacy key: %v", err)
+	}
+
+	var tarBuffer bytes.Buffer
+	tarWriter := tar.NewWriter(&tarBuffer)
+	writeBlockEntry(t, tarWriter, 1, fmt.Appendf(nil,
+		"{\"tx_index\":0,\"op_index\":0,\"expire\":%s}\n{\"tx_index\":1,\"op_index\":0,\"delete\":%s}\n",
+		legacyExpire, legacyDelete,
+	))
+	writeBlockEntry(t, tarWriter, 2, fmt.Appendf(nil,
+		"{\"tx_index\":1,\"op_index\":0,\"delete\":%q}\n",
+		deletedKey.Hex(),
+	))
+	err = tarWriter.Close()
+	if err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+
+	var resultBlocks []events.Block
+	for item := range IterateTar(10, &tarBuffer) {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		resultBlocks = append(resultBlocks, item.Batch.Blocks...)
+	}
+
+	expected := []events.Block{
+		{
+			Number: 1,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Sequence: 0, Expire: &events.OPExpire{Key: expiredKey}},
+				{TxIndex: 1, OpIndex: 0, Sequence: 1, Delete: &events.OPDelete{Key: deletedKey}},
+			},
+		},
+		{
+			Number: 2,
+			Operations: []events.Operation{
+				{TxIndex: 1, OpIndex: 0, Delete: &events.OPDelete{Key: deletedKey}},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, resultBlocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestIterateTarWorkers(t *testing.T) {
+	var archive bytes.Buffer
+	writer, err := NewWriter(&archive)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for number := uint64(1); number <= 50; number++ {
+		operations := []events.Operation{}
+		for i := range number % 4 {
+			operations = append(operations, events.Operation{
+				TxIndex:  i,
+				Sequence: i,
+				Expire:   &events.OPExpire{Key: common.BigToHash(new(big.Int).SetUint64(number*10 + i))},
+			})
+		}
+		err = writer.WriteBlock(events.Block{Number: number, Timestamp: 1700000000 + number, Operations: operations})
+		if err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	collect := func(maxBatches int, opts ...Option) [][]events.Block {
+		t.Helper()
+		batches := [][]events.Block{}
+		for item := range IterateTar(7, bytes.NewReader(archive.Bytes()), opts...) {
+			if item.Error != nil {
+				t.Fatalf("unexpected error during iteration: %v", item.Error)
+			}
+			batches = append(batches, item.Batch.Blocks)
+			if len(batches) == maxBatches {
+				break
+			}
+		}
+		return batches
+	}
+
+	serial := collect(-1)
+	if len(serial) != 8 {
+		t.Fatalf("expected 8 batches, got %d", len(serial))
+	}
+	if diff := cmp.Diff(serial, collect(-1, WithWorkers(4))); diff != "" {
+		t.Fatalf("unexpected batches with workers (-serial +parallel):\n%s", diff)
+	}
+	if diff := cmp.Diff(serial[:2], collect(2, WithWorkers(4))); diff != "" {
+		t.Fatalf("unexpected batches when stopping early (-serial +parallel):\n%s", diff)
+	}
+
+	corrupted := bytes.Clone(archive.Bytes())
+	offset := writer.Index().Entries[20].Offset + 512
+	copy(corrupted[offset:], "not zstd")
+	blocks := 0
+	var iterErr error
+	for item := range IterateTar(7, bytes.NewReader(corrupted), WithWorkers(4)) {
+		if item.Error != nil {
+			iterErr = item.Error
+			continue
+		}
+		blocks += len(item.Batch.Blocks)
+	}
+	if iterErr == nil {
+		t.Fatalf("expected an error for a corrupted entry")
+	}
+	if blocks != 14 {
+		t.Fatalf("expected the 14 blocks of full batches before the corrupted block, got %d", blocks)
+	}
+}
+
+func TestIterateTarBlockRange(t *testing.T) {
+	var archive bytes.Buffer
+	writer, err := NewWriter(&archive)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for number := uint64(1); number <= 30; number++ {
+		err = writer.WriteBlock(events.Block{
+			Number: number,
+			Operations: []events.Operation{
+				{Expire: &events.OPExpire{Key: common.BigToHash(new(big.Int).SetUint64(number))}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	// Entries outside the range are never decompressed, so corrupting one is harmless.
+	corrupted := bytes.Clone(archive.Bytes())
+	copy(corrupted[writer.Index().Entries[4].Offset+512:], "not zstd")
+
+	for _, workers := range []int{1, 4} {
+		reader := &countingReadSeeker{ReadSeeker: bytes.NewReader(corrupted)}
+		blocks := []events.Block{}
+		for item := range IterateTar(4, reader, WithBlockRange(10, 15), WithWorkers(workers)) {
+			if item.Error != nil {
+				t.Fatalf("unexpected error during iteration with %d workers: %v", workers, item.Error)
+			}
+			blocks = append(blocks, item.Batch.Blocks...)
+		}
+
+		if diff := cmp.Diff([]uint64{10, 11, 12, 13, 14, 15}, blockNumbers(blocks)); diff != "" {
+			t.Fatalf("unexpected blocks with %d workers (-want +got):\n%s", workers, diff)
+		}
+		if reader.read >= len(corrupted)/2 {
+			t.Fatalf("expected reading to stop after the range, read %d of %d bytes with %d workers", reader.read, len(corrupted), workers)
+		}
+	}
+}
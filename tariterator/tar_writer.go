@@ -0,0 +1,233 @@
+package tariterator
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/klauspost/compress/zstd"
+)
+
+// blockEntryName returns the name of the archive entry holding the given block.
+// Block numbers are zero-padded so that entries sort by name in block order.
+func blockEntryName(number uint64) string {
+	return fmt.Sprintf("block-%020d.json.zst", number)
+}
+
+// headerRecord is the JSON value a BlockHeader is written as.
+type headerRecord struct {
+	BlockHeader BlockHeader `json:"block_header"`
+}
+
+// WriterOption configures a Writer.
+type WriterOption func(*Writer)
+
+// WithIndex makes the writer record the offset of every block entry and write
+// the resulting Index to w when it is closed.
+func WithIndex(w io.Writer) WriterOption {
+	return func(writer *Writer) {
+		writer.indexOut = w
+	}
+}
+
+// WithCompressionLevel sets the zstd level block entries are compressed with.
+// It defaults to zstd.SpeedDefault.
+func WithCompressionLevel(level zstd.EncoderLevel) WriterOption {
+	return func(w *Writer) {
+		w.level = level
+	}
+}
+
+// Writer writes blocks to a tar archive in the format read by IterateTar.
+// Blocks must be written in ascending order. Close must be called to complete
+// the archive; it does not close the underlying writer.
+type Writer struct {
+	out       io.Writer
+	counter   *countingWriter
+	tarWriter *tar.Writer
+	encoder   *zstd.Encoder
+	level     zstd.EncoderLevel
+	buffer    bytes.Buffer
+	lastBlock *uint64
+	index     Index
+	indexOut  io.Writer
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewWriter creates a Writer writing an archive to w.
+func NewWriter(w io.Writer, opts ...WriterOption) (*Writer, error) {
+	counter := &countingWriter{w: w}
+	writer := &Writer{
+		out:       w,
+		counter:   counter,
+		tarWriter: tar.NewWriter(counter),
+		level:     zstd.SpeedDefault,
+		index:     Index{Entries: []IndexEntry{}},
+	}
+	for _, opt := range opts {
+		opt(writer)
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(writer.level))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+	writer.encoder = encoder
+
+	return writer, nil
+}
+
+// WriteBlock appends block to the archive. Its header record is only written
+// if the block carries a hash, parent hash or timestamp.
+func (w *Writer) WriteBlock(block events.Block) error {
+	if w.lastBlock != nil && block.Number <= *w.lastBlock {
+		return fmt.Errorf("block %d written after block %d", block.Number, *w.lastBlock)
+	}
+
+	w.buffer.Reset()
+	encoder := json.NewEncoder(&w.buffer)
+
+	if block.Hash != (common.Hash{}) || block.ParentHash != (common.Hash{}) || block.Timestamp != 0 {
+		err := encoder.Encode(headerRecord{BlockHeader: BlockHeader{
+			Hash:       block.Hash,
+			ParentHash: block.ParentHash,
+			Timestamp:  block.Timestamp,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to encode header of block %d: %w", block.Number, err)
+		}
+	}
+
+	for _, operation := range block.Operations {
+		err := encoder.Encode(operation)
+		if err != nil {
+			return fmt.Errorf("failed to encode operation of block %d: %w", block.Number, err)
+		}
+	}
+
+	compressed := w.encoder.EncodeAll(w.buffer.Bytes(), nil)
+
+	header := &tar.Header{
+		Name: blockEntryName(block.Number),
+		Size: int64(len(compressed)),
+		Mode: 0644,
+	}
+	if block.Timestamp != 0 {
+		header.ModTime = time.Unix(int64(block.Timestamp), 0)
+	}
+
+	// Pad the previous entry, so that the header starts at the counted offset.
+	err := w.tarWriter.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush tar writer: %w", err)
+	}
+	offset := w.counter.n
+
+	err = w.tarWriter.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to write tar header of block %d: %w", block.Number, err)
+	}
+	_, err = w.tarWriter.Write(compressed)
+	if err != nil {
+		return fmt.Errorf("failed to write tar content of block %d: %w", block.Number, err)
+	}
+
+	number := block.Number
+	w.lastBlock = &number
+	w.index.Entries = append(w.index.Entries, IndexEntry{Block: number, Offset: offset})
+	return nil
+}
+
+// Index returns the index of the blocks written so far.
+func (w *Writer) Index() *Index {
+	return &Index{Entries: slices.Clone(w.index.Entries)}
+}
+
+// Flush writes the padding of the last block entry and flushes the underlying
+// writer if it has a Flush method, so that all written blocks are readable
+// before the archive is closed.
+func (w *Writer) Flush() error {
+	err := w.tarWriter.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush tar writer: %w", err)
+	}
+	if flusher, ok := w.out.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close writes the end of the archive and flushes the underlying writer.
+// If the writer was created WithIndex, the index is written as well.
+func (w *Writer) Close() error {
+	w.encoder.Close()
+	err := w.tarWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if w.indexOut != nil {
+		err = w.index.Write(w.indexOut)
+		if err != nil {
+			return err
+		}
+	}
+	if flusher, ok := w.out.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// ErrRollback is returned by WriteTar if the iterator yields a rollback,
+// as blocks already written to an archive cannot be taken back.
+var ErrRollback = errors.New("rollback cannot be written to an archive")
+
+// WriteTar writes all blocks yielded by iterator to an archive written to w,
+// flushing after every batch. It stops at the first error or rollback yielded
+// by the iterator, in which case the archive is left incomplete; iterators that
+// may yield rollbacks should follow finalized blocks only.
+func WriteTar(w io.Writer, iterator arkivevents.BatchIterator, opts ...WriterOption) error {
+	writer, err := NewWriter(w, opts...)
+	if err != nil {
+		return err
+	}
+
+	for item := range iterator {
+		if item.Error != nil {
+			return item.Error
+		}
+		if item.Rollback != nil {
+			return fmt.Errorf("block %d: %w", item.Rollback.FirstInvalidBlock, ErrRollback)
+		}
+		for _, block := range item.Batch.Blocks {
+			err = writer.WriteBlock(block)
+			if err != nil {
+				return err
+			}
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
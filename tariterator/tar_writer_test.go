@@ -0,0 +1,145 @@
+package tariterator
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	arkivevents "github.com/Arkiv-Network/arkiv-events"
+	"github.com/Arkiv-Network/arkiv-events/events"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// iterateItems yields the given items as a BatchIterator.
+func iterateItems(items ...arkivevents.BatchOrError) arkivevents.BatchIterator {
+	return func(yield func(arkivevents.BatchOrError) bool) {
+		for _, item := range items {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+func batchOf(blocks ...events.Block) arkivevents.BatchOrError {
+	return arkivevents.BatchOrError{Batch: events.BlockBatch{Blocks: blocks}}
+}
+
+func TestWriteTar(t *testing.T) {
+	owner := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	blocks := []events.Block{
+		{Number: 9, Operations: []events.Operation{}},
+		{
+			Number:     10,
+			Hash:       common.HexToHash("0x10"),
+			ParentHash: common.HexToHash("0x09"),
+			Timestamp:  1700000020,
+			Operations: []events.Operation{
+				{TxIndex: 0, OpIndex: 0, Sequence: 0, Expire: &events.OPExpire{Key: common.HexToHash("0x01"), Owner: owner}},
+				{TxIndex: 1, OpIndex: 0, Sequence: 1, TxHash: common.HexToHash("0xaa"), From: owner, Create: &events.OPCreate{
+					Key:               common.HexToHash("0x02"),
+					ContentType:       "text/plain",
+					BTL:               100,
+					Owner:             owner,
+					Content:           []byte("hello"),
+					StringAttributes:  map[string]string{"key": "value"},
+					NumericAttributes: map[string]uint64{"key": 1},
+					ExpirationBlock:   110,
+				}},
+				{TxIndex: 1, OpIndex: 1, Sequence: 2, TxHash: common.HexToHash("0xaa"), From: owner, Delete: &events.OPDelete{Key: common.HexToHash("0x03"), Owner: owner}},
+			},
+		},
+		{Number: 1000, Hash: common.HexToHash("0x1000"), Operations: []events.Operation{}},
+	}
+
+	var archive bytes.Buffer
+	err := WriteTar(&archive, iterateItems(batchOf(blocks[:2]...), batchOf(blocks[2:]...)), WithCompressionLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+
+	names := []string{}
+	tarReader := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar header: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	expectedNames := []string{
+		"block-00000000000000000009.json.zst",
+		"block-00000000000000000010.json.zst",
+		"block-00000000000000001000.json.zst",
+	}
+	if diff := cmp.Diff(expectedNames, names); diff != "" {
+		t.Fatalf("unexpected entry names (-want +got):\n%s", diff)
+	}
+
+	// Sequence is derived from the order of records, so it is not written.
+	tarReader = tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for range 2 {
+		_, err = tarReader.Next()
+		if err != nil {
+			t.Fatalf("failed to read tar header: %v", err)
+		}
+	}
+	eventsReader, err := zstd.NewReader(tarReader)
+	if err != nil {
+		t.Fatalf("failed to create zstd reader: %v", err)
+	}
+	content, err := io.ReadAll(eventsReader)
+	eventsReader.Close()
+	if err != nil {
+		t.Fatalf("failed to read entry: %v", err)
+	}
+	if bytes.Contains(content, []byte(`"sequence"`)) {
+		t.Fatalf("expected no sequence in the archive, got %s", content)
+	}
+
+	var resultBlocks []events.Block
+	for item := range IterateTar(2, &archive) {
+		if item.Error != nil {
+			t.Fatalf("unexpected error during iteration: %v", item.Error)
+		}
+		resultBlocks = append(resultBlocks, item.Batch.Blocks...)
+	}
+	if diff := cmp.Diff(blocks, resultBlocks); diff != "" {
+		t.Fatalf("unexpected blocks (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteTarRollback(t *testing.T) {
+	var archive bytes.Buffer
+	err := WriteTar(&archive, iterateItems(
+		batchOf(events.Block{Number: 1, Operations: []events.Operation{}}),
+		arkivevents.BatchOrError{Rollback: &arkivevents.Rollback{FirstInvalidBlock: 1}},
+	))
+	if !errors.Is(err, ErrRollback) {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+}
+
+func TestWriterBlockOrder(t *testing.T) {
+	writer, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	err = writer.WriteBlock(events.Block{Number: 2, Operations: []events.Operation{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = writer.WriteBlock(events.Block{Number: 2, Operations: []events.Operation{}})
+	if err == nil {
+		t.Fatalf("expected an error for a block written twice")
+	}
+}